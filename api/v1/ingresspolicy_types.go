@@ -0,0 +1,71 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IngressPolicySpec defines which external requests may keep the layer header at the ingress gateways.
+type IngressPolicySpec struct {
+	// Selector - labels of the ingress gateway workloads, by default istio: ingressgateway.
+	Selector map[string]string `json:"selector,omitempty"`
+	// Allow - a request keeps the layer header if any rule allows it, otherwise the header is removed.
+	Allow []IngressAllowRule `json:"allow,omitempty"`
+}
+
+// IngressAllowRule allows requests which match all of its fields to select a layer.
+type IngressAllowRule struct {
+	// IPBlocks - IPv4 addresses or CIDR ranges the request must come from.
+	IPBlocks []string `json:"ipBlocks,omitempty"`
+	// JWT - the request must carry a valid JWT from the issuer, with the claims.
+	JWT *LayerJWT `json:"jwt,omitempty"`
+}
+
+// IngressPolicyStatus defines the observed state of IngressPolicy.
+type IngressPolicyStatus struct {
+	// Current state of the policy
+	State   string `json:"state,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+
+// IngressPolicy is the Schema for the ingresspolicies API.
+// The layer header is removed from requests entering through the ingress gateways unless a rule allows them.
+type IngressPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IngressPolicySpec   `json:"spec,omitempty"`
+	Status IngressPolicyStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// IngressPolicyList contains a list of IngressPolicy.
+type IngressPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IngressPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IngressPolicy{}, &IngressPolicyList{})
+}
@@ -32,6 +32,114 @@ type LayerSpec struct {
 	// Layers at the same node-level - are alternates
 	// if unspecified, the layer is a child of the root layer
 	Parent string `json:"parent,omitempty"`
+
+	// Entry - optional additional ways a request can enter this layer other than the layer header.
+	// Requests matched this way have the layer header set on them, so downstream services
+	// only ever need to propagate the header.
+	Entry *LayerEntry `json:"entry,omitempty"`
+
+	// Enrollment - optionally puts a percentage of the users sending requests without a layer into this one.
+	Enrollment *LayerEnrollment `json:"enrollment,omitempty"`
+
+	// Suspend - when true the layer's LayerServices are not routed, requests in the layer fall back
+	// to the parent's routes (or the default) until it is unset. The Layer and its LayerServices are kept.
+	Suspend bool `json:"suspend,omitempty"`
+
+	// Access - optionally restricts which requests may enter the layer, by default any request may.
+	Access *LayerAccess `json:"access,omitempty"`
+
+	// Analysis - optionally compares the layer's requests with those of the default route, and reports
+	// (or suspends) the layer when they are worse. Only done for cluster Layers, with a metrics endpoint configured.
+	Analysis *LayerAnalysis `json:"analysis,omitempty"`
+
+	// Template - optionally stamps out the LayerServices of a LayerTemplate for the layer.
+	// Only done for cluster Layers.
+	Template *LayerTemplateRef `json:"template,omitempty"`
+}
+
+// LayerTemplateRef refers to the LayerTemplate whose LayerServices are stamped out for a layer.
+type LayerTemplateRef struct {
+	// Name of the LayerTemplate
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// Parameters - values of the template's parameters.
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// LayerAnalysis defines how much worse the requests entering a layer may be than those of the default route.
+type LayerAnalysis struct {
+	// Interval between analyses, by default a minute.
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// Window - range of the rates compared, a prometheus duration, by default 5m.
+	// +kubebuilder:validation:Pattern=`^[0-9]+[smhdwy]$`
+	Window string `json:"window,omitempty"`
+	// MaxErrorRateIncrease - percentage points by which the layer's 5xx rate may exceed the default route's.
+	// +kubebuilder:default=5
+	// +kubebuilder:validation:Minimum=0
+	MaxErrorRateIncrease int32 `json:"maxErrorRateIncrease,omitempty"`
+	// MaxLatencyIncrease - percent by which the layer's p95 latency may exceed the default route's.
+	// +kubebuilder:default=50
+	// +kubebuilder:validation:Minimum=0
+	MaxLatencyIncrease int32 `json:"maxLatencyIncrease,omitempty"`
+	// AutoSuspend - when true a degraded layer is suspended, otherwise it is only reported.
+	AutoSuspend bool `json:"autoSuspend,omitempty"`
+}
+
+// LayerAccess restricts the requests which may enter a layer. A request may enter if it is from one of the
+// principals or namespaces, or carries a JWT from the issuer with all the claims.
+// Requests which enter through a service must come from a workload it allows, so the services in the layer
+// forwarding the layer header are usually allowed by namespace.
+type LayerAccess struct {
+	// Principals - source principals which may enter the layer, e.g. "cluster.local/ns/ci/sa/tester".
+	Principals []string `json:"principals,omitempty"`
+	// Namespaces - source namespaces which may enter the layer.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// JWT - requests carrying a valid JWT from the issuer, with the claims, may enter the layer.
+	JWT *LayerJWT `json:"jwt,omitempty"`
+}
+
+// LayerJWT is a JWT a request may carry to enter a layer.
+type LayerJWT struct {
+	// Issuer of the JWT
+	// +kubebuilder:validation:Required
+	Issuer string `json:"issuer"`
+	// JWKSURI - URL of the issuer's public keys, by default discovered from the issuer.
+	JWKSURI string `json:"jwksUri,omitempty"`
+	// Claims the JWT must have, each to one of the values given.
+	Claims map[string][]string `json:"claims,omitempty"`
+}
+
+// LayerEntry defines how a request without the layer header can select a layer.
+// In each case the value matched is the name of the layer.
+type LayerEntry struct {
+	// Cookie - name of a cookie whose value selects the layer, e.g. for "x-route" a request
+	// carrying "Cookie: x-route=feature-x" enters the layer "feature-x".
+	Cookie string `json:"cookie,omitempty"`
+	// QueryParam - name of a query parameter whose value selects the layer,
+	// e.g. for "layer" a request for "/?layer=feature-x" enters the layer "feature-x".
+	QueryParam string `json:"queryParam,omitempty"`
+	// Subdomain - when true a request whose authority starts with "<layer>." enters the layer,
+	// e.g. "feature-x.http-echo" enters the layer "feature-x".
+	Subdomain bool `json:"subdomain,omitempty"`
+}
+
+// LayerEnrollment puts a percentage of users into a layer without them setting the layer header.
+// Users are given a cookie, so those enrolled stay in the layer and those not stay out of it.
+type LayerEnrollment struct {
+	// Percentage of users enrolled. At 0 no more users are enrolled, those already enrolled stay.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	Percentage int32 `json:"percentage"`
+	// Cookie - name of the cookie keeping a user in (or out of) the layer, by default "routelayer-<layer>".
+	// +kubebuilder:validation:Pattern=`^[A-Za-z0-9_.-]+$`
+	Cookie string `json:"cookie,omitempty"`
+	// HashHeader - optionally a request header identifying the user, e.g. "x-user-id". Users carrying it are
+	// enrolled by the last two hex digits of its value rather than at random, so the same users are always enrolled.
+	// Its values must end in evenly spread hex digits, as UUIDs and hashes do.
+	HashHeader string `json:"hashHeader,omitempty"`
+	// HashCookie - optionally a cookie identifying the user, e.g. a session id, used in the same way as HashHeader.
+	// +kubebuilder:validation:Pattern=`^[A-Za-z0-9_.-]+$`
+	HashCookie string `json:"hashCookie,omitempty"`
 }
 
 // Important: Run "make" to regenerate code after modifying this file
@@ -42,6 +150,23 @@ type LayerStatus struct {
 	// TODO insert known FSM's,
 	State   string `json:"state,omitempty"`
 	Message string `json:"message,omitempty"`
+	// Conditions - Degraded is true when the layer's requests are worse than the default route's.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// LastAnalysisTime - when the layer's requests were last analyzed, they are analyzed again once the interval passes.
+	// +optional
+	LastAnalysisTime *metav1.Time `json:"lastAnalysisTime,omitempty"`
+	// Services - the number of LayerServices in the layer.
+	// +optional
+	Services int32 `json:"services,omitempty"`
+	// ReadyServices - the number of them routed, with a ready endpoint to serve their destination.
+	// +optional
+	ReadyServices int32 `json:"readyServices,omitempty"`
+	// Hosts - the hosts the layer overrides.
+	// +optional
+	Hosts []string `json:"hosts,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -66,7 +191,7 @@ type LayerList struct {
 	Items           []Layer `json:"items"`
 }
 
-// LayerServiceSpec defines the desired state of Layer.
+// LayerServiceSpec defines the desired state of LayerService.
 type LayerServiceSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
@@ -84,34 +209,89 @@ type LayerServiceSpec struct {
 	// Destination - optional destination (must be different from the host)
 	// Either Destination or Labels must be specified.
 	Destination string `json:"destination,omitempty"`
+	// DestinationTLS - the destination is outside the cluster and only serves TLS, on port 443 (e.g. a payment
+	// provider's sandbox). Requests must reach the sidecar as plain HTTP to be routed by layer, the sidecar then
+	// originates the TLS connection to the destination.
+	DestinationTLS bool `json:"destinationTLS,omitempty"`
+	// EgressGateway - the service of the istio egress gateway (e.g. istio-egressgateway.istio-system) requests in
+	// the layer to a host outside the cluster leave the mesh through, rather than routelayer's default egress.
+	EgressGateway string `json:"egressGateway,omitempty"`
+	// Protocol - the protocol the host speaks, defaults to http.
+	// For http2 and grpc the generated DestinationRule upgrades and balances connections accordingly.
+	// For tcp and tls no headers are visible - the layer is selected by Ports (tcp) or by
+	// the SNI "<layer>.<host>" (tls) instead.
+	// +kubebuilder:validation:Enum=http;http2;grpc;tcp;tls
+	Protocol string `json:"protocol,omitempty"`
+	// Ports - optional ports of the host the override applies to, by default it applies to all of them.
+	// Requests to any other port of the host (e.g. metrics or admin) are left on the default route.
+	// For tcp at least one is required, connections to these ports of the host enter the layer.
+	Ports []uint32 `json:"ports,omitempty"`
+	// Adopt - when a VirtualService not generated by routelayer already routes the host, merge the layer routes
+	// in front of its routes (which are preserved) rather than reporting a conflict.
+	// The host is adopted if any of its LayerServices sets this.
+	Adopt bool `json:"adopt,omitempty"`
 }
 
+// Protocols a LayerService host may speak.
+const (
+	ProtocolHTTP  = "http"
+	ProtocolHTTP2 = "http2"
+	ProtocolGRPC  = "grpc"
+	ProtocolTCP   = "tcp"
+	ProtocolTLS   = "tls"
+)
+
+// LayerServiceStatus defines the observed state of LayerService.
 type LayerServiceStatus struct {
 	// Current state of the layerservice
 	// TODO insert known FSM's,
-	State string `json:"state,omitempty"`
+	State   string `json:"state,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Conditions - Conflict is true when a VirtualService not generated by routelayer routes the host,
+	// and the host is not adopted.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Host - the FQDN of the host the LayerService was last routed for.
+	Host string `json:"host,omitempty"`
+	// Revision of the host's route table, it increases whenever the table changes.
+	Revision int64 `json:"revision,omitempty"`
+	// Snapshot - the ConfigMap, in the host's namespace, the revision of the route table is kept in.
+	Snapshot string `json:"snapshot,omitempty"`
+	// Routes - the host's route table as of the revision.
+	Routes []LayerRoute `json:"routes,omitempty"`
+}
+
+// LayerRoute is where requests in a layer to a host are routed.
+type LayerRoute struct {
+	Layer       string `json:"layer"`
+	Destination string `json:"destination"`
+	Subset      string `json:"subset,omitempty"`
+	// Fallback - the layers walked from the layer to the one whose LayerService supplies the destination.
+	Fallback []string `json:"fallback,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 // +kubebuilder:resource:scope=Namespaced
 
-// LayerService is the Schema for the layers API.
+// LayerService is the Schema for the layerservices API.
 type LayerService struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec   LayerSpec   `json:"spec,omitempty"`
-	Status LayerStatus `json:"status,omitempty"`
+	Spec   LayerServiceSpec   `json:"spec,omitempty"`
+	Status LayerServiceStatus `json:"status,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 
-// LayerServiceList contains a list of Layer.
+// LayerServiceList contains a list of LayerService.
 type LayerServiceList struct {
 	metav1.TypeMeta `json:",inline"`
 	metav1.ListMeta `json:"metadata,omitempty"`
-	Items           []Layer `json:"items"`
+	Items           []LayerService `json:"items"`
 }
 
 func init() {
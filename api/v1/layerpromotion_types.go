@@ -0,0 +1,78 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LayerPromotionSpec defines the layer to promote into its parent.
+type LayerPromotionSpec struct {
+	// Layer - the cluster Layer whose LayerServices are moved into its parent.
+	// +kubebuilder:validation:Required
+	Layer string `json:"layer"`
+	// KeepLayer - when true the emptied layer is kept, by default it is deleted.
+	KeepLayer bool `json:"keepLayer,omitempty"`
+}
+
+// LayerPromotionStatus defines the observed state of LayerPromotion.
+type LayerPromotionStatus struct {
+	// Current state of the promotion
+	State   string `json:"state,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Parent the layer was promoted into.
+	Parent string `json:"parent,omitempty"`
+	// Services - the LayerServices promoted, planned before any is.
+	Services []PromotedService `json:"services,omitempty"`
+}
+
+// PromotedService is a LayerService moved into the parent layer.
+type PromotedService struct {
+	// LayerService - namespace/name of the promoted LayerService.
+	LayerService string `json:"layerService"`
+	Host         string `json:"host"`
+	// MergedInto - namespace/name of the parent's LayerService for the host, which took the promoted destination.
+	// Empty when the parent had none, and the LayerService itself was moved.
+	MergedInto string `json:"mergedInto,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+
+// LayerPromotion is the Schema for the layerpromotions API.
+// It moves every LayerService of a layer into the layer's parent, once, then deletes the emptied layer.
+type LayerPromotion struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LayerPromotionSpec   `json:"spec,omitempty"`
+	Status LayerPromotionStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// LayerPromotionList contains a list of LayerPromotion.
+type LayerPromotionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []LayerPromotion `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&LayerPromotion{}, &LayerPromotionList{})
+}
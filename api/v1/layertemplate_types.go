@@ -0,0 +1,104 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LayerTemplateSpec describes the LayerServices stamped out for each Layer using the template.
+// "${layer}" in any string of the services is replaced by the name of the Layer, and "${<name>}" by the value
+// of the parameter.
+type LayerTemplateSpec struct {
+	// Parameters the Layers using the template may set.
+	Parameters []LayerTemplateParameter `json:"parameters,omitempty"`
+	// Services - the LayerServices stamped out for each Layer.
+	Services []LayerServiceTemplate `json:"services,omitempty"`
+}
+
+// LayerTemplateParameter is a value a Layer using the template may set.
+type LayerTemplateParameter struct {
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// Default value, a Layer must set a parameter without one.
+	Default *string `json:"default,omitempty"`
+}
+
+// LayerServiceTemplate is a LayerService stamped out for each Layer using the template.
+type LayerServiceTemplate struct {
+	// Name of the LayerService, e.g. "echo-${layer}".
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// Namespace of the LayerService.
+	// +kubebuilder:validation:Required
+	Namespace string `json:"namespace"`
+	// Spec of the LayerService, its layer is set to the Layer stamping it out.
+	Spec LayerServiceTemplateSpec `json:"spec"`
+	// Workload - optionally a Deployment cloned for each Layer, with some of its images overridden, whose pods
+	// the LayerService's labels select.
+	Workload *LayerWorkloadTemplate `json:"workload,omitempty"`
+}
+
+// LayerWorkloadTemplate is a Deployment cloned for each Layer using the template, named "<deployment>-<layer>".
+// The clone's pods, and its selector, have the LayerService's labels added, which must tell them apart from the
+// Deployment's own pods.
+type LayerWorkloadTemplate struct {
+	// Deployment - name of the Deployment to clone, in the namespace of the LayerService.
+	// +kubebuilder:validation:Required
+	Deployment string `json:"deployment"`
+	// Images of the clone's containers, by container name, e.g. {"echo": "http-echo:${version}"}.
+	Images map[string]string `json:"images,omitempty"`
+}
+
+// LayerServiceTemplateSpec is a LayerServiceSpec without the layer.
+type LayerServiceTemplateSpec struct {
+	// +kubebuilder:validation:Required
+	Host           string            `json:"host"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Destination    string            `json:"destination,omitempty"`
+	DestinationTLS bool              `json:"destinationTLS,omitempty"`
+	EgressGateway  string            `json:"egressGateway,omitempty"`
+	// +kubebuilder:validation:Enum=http;http2;grpc;tcp;tls
+	Protocol string   `json:"protocol,omitempty"`
+	Ports    []uint32 `json:"ports,omitempty"`
+	Adopt    bool     `json:"adopt,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+
+// LayerTemplate is the Schema for the layertemplates API.
+// Layers referring to it in spec.template have its LayerServices stamped out for them.
+type LayerTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec LayerTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// LayerTemplateList contains a list of LayerTemplate.
+type LayerTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []LayerTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&LayerTemplate{}, &LayerTemplateList{})
+}
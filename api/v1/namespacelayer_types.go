@@ -0,0 +1,91 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Namespaced
+
+// NamespaceLayer is a Layer whose routing effects are restricted to the hosts of its own namespace.
+// Only LayerServices in the same namespace can refer to it, and within that namespace it takes
+// precedence over a cluster Layer of the same name.
+// Its parent must be a cluster Layer which a LayerPolicy permits the namespace to attach to.
+type NamespaceLayer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LayerSpec   `json:"spec,omitempty"`
+	Status LayerStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// NamespaceLayerList contains a list of NamespaceLayer.
+type NamespaceLayerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NamespaceLayer `json:"items"`
+}
+
+// LayerPolicySpec defines which namespaces may attach NamespaceLayers to which cluster Layers,
+// and which namespaces may override hosts in other namespaces.
+type LayerPolicySpec struct {
+	// Rules - a namespace is permitted something when any rule of any LayerPolicy allows it.
+	Rules []LayerPolicyRule `json:"rules,omitempty"`
+}
+
+// LayerPolicyRule allows the namespaces to attach to the layers and to override the hosts of the host namespaces.
+type LayerPolicyRule struct {
+	// Namespaces the rule applies to, "*" matches all namespaces.
+	// +kubebuilder:validation:Required
+	Namespaces []string `json:"namespaces"`
+	// Layers - cluster Layers which NamespaceLayers in the namespaces may use as their parent, "*" matches all layers.
+	Layers []string `json:"layers,omitempty"`
+	// HostNamespaces - namespaces whose hosts LayerServices in the namespaces may override, "*" matches all namespaces.
+	// A LayerService may always override the hosts of its own namespace.
+	HostNamespaces []string `json:"hostNamespaces,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+
+// LayerPolicy is the Schema for the layerpolicies API.
+// Without any LayerPolicy no NamespaceLayer may attach to a cluster Layer.
+type LayerPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec LayerPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// LayerPolicyList contains a list of LayerPolicy.
+type LayerPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []LayerPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NamespaceLayer{}, &NamespaceLayerList{})
+	SchemeBuilder.Register(&LayerPolicy{}, &LayerPolicyList{})
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RouteRollbackSpec defines which route table snapshots to roll back to.
+// Either a Revision of a Host, or the revisions of every host (or only Host) in effect Before a time.
+type RouteRollbackSpec struct {
+	// Host - FQDN of the host to roll back, e.g. http-echo.routing-demo.svc.cluster.local. All hosts when empty.
+	Host string `json:"host,omitempty"`
+	// Revision of the host's route table to roll back to, requires Host.
+	Revision int64 `json:"revision,omitempty"`
+	// Before - roll back to the latest revision of each host's route table kept before this time.
+	Before *metav1.Time `json:"before,omitempty"`
+}
+
+// RouteRollbackStatus defines the observed state of RouteRollback.
+type RouteRollbackStatus struct {
+	// Current state of the rollback
+	State   string `json:"state,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Hosts - the hosts rolled back and the snapshots they are routed from.
+	Hosts []RolledBackHost `json:"hosts,omitempty"`
+}
+
+// RolledBackHost is a host whose routing is rolled back to a snapshot of its route table.
+type RolledBackHost struct {
+	Host      string `json:"host"`
+	Namespace string `json:"namespace"`
+	Revision  int64  `json:"revision"`
+	// Snapshot - the ConfigMap holding the revision.
+	Snapshot string `json:"snapshot"`
+	// Missing - true when the snapshot no longer exists, the host is routed from its LayerServices instead.
+	Missing bool `json:"missing,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+
+// RouteRollback is the Schema for the routerollbacks API.
+// While it exists the hosts it covers are routed from the snapshots of their route tables,
+// and their LayerServices are paused. Deleting it clears the rollback.
+type RouteRollback struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RouteRollbackSpec   `json:"spec,omitempty"`
+	Status RouteRollbackStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// RouteRollbackList contains a list of RouteRollback.
+type RouteRollbackList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []RouteRollback `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&RouteRollback{}, &RouteRollbackList{})
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"flag"
 	"os"
@@ -26,10 +27,13 @@ import (
 	"go.uber.org/zap/zapcore"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
@@ -37,7 +41,11 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+	"github.com/fergalsomers/routelayer/internal/analysis"
 	"github.com/fergalsomers/routelayer/internal/controller"
+	"github.com/fergalsomers/routelayer/internal/preview"
+	"github.com/fergalsomers/routelayer/internal/remote"
+	"github.com/fergalsomers/routelayer/internal/routing"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -59,6 +67,16 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var enableIstio bool
+	var layerHeader string
+	var clusterDomain string
+	var snapshotRevisions int
+	var rootNamespace string
+	var accessLogProvider string
+	var prometheusURL string
+	var remoteClustersNamespace string
+	var egressGateway string
+	var previewAddr, previewTemplate, previewParent, previewPrefix, previewSecretFile string
 	var tlsOpts []func(*tls.Config)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
@@ -70,6 +88,39 @@ func main() {
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.BoolVar(&enableIstio, "enable-istio", false,
+		"If set, istio VirtualServices and DestinationRules are generated for the LayerServices.")
+	flag.StringVar(&layerHeader, "layer-header", routing.DefaultLayerHeader,
+		"The request header used to select a layer. Matched requests always have this header set.")
+	flag.StringVar(&clusterDomain, "cluster-domain", routing.DefaultClusterDomain,
+		"The DNS domain of the cluster, used to normalize LayerService hosts to fully qualified names.")
+	flag.IntVar(&snapshotRevisions, "snapshot-revisions", routing.DefaultSnapshotRevisions,
+		"The number of revisions of each host's route table kept as snapshots.")
+	flag.StringVar(&rootNamespace, "istio-root-namespace", routing.DefaultRootNamespace,
+		"The istio root namespace, where the access policies of cluster Layers and the ingress filters are generated.")
+	flag.StringVar(&accessLogProvider, "access-log-provider", "",
+		"The istio extension provider writing the access logs of workloads taking part in layers, "+
+			"e.g. routelayer-envoy from istio/istio-profile.yaml. Leave empty to keep the mesh default.")
+	flag.StringVar(&remoteClustersNamespace, "remote-clusters-namespace", "",
+		"The namespace of the Secrets holding the kubeconfigs of the remote clusters of the mesh, labelled "+
+			remote.SecretLabel+"=true. Routes are also programmed in those clusters. Disabled when empty.")
+	flag.StringVar(&egressGateway, "egress-gateway", "",
+		"The service of the istio egress gateway requests to hosts outside the cluster leave the mesh through, "+
+			"e.g. istio-egressgateway.istio-system. Leave empty for requests to leave directly.")
+	flag.StringVar(&prometheusURL, "prometheus-url", "",
+		"The URL of a Prometheus compatible API queried to analyze layers, e.g. http://prometheus.istio-system:9090. "+
+			"Leave empty to disable layer analysis.")
+	flag.StringVar(&previewAddr, "preview-bind-address", "0",
+		"The address pull request events are received on, at "+preview.Path+", e.g. :8082. "+
+			"Leave as 0 to disable preview layers.")
+	flag.StringVar(&previewTemplate, "preview-template", "",
+		"The LayerTemplate stamped out for the preview layer of each pull request.")
+	flag.StringVar(&previewParent, "preview-parent", "", "The parent Layer of the preview layers.")
+	flag.StringVar(&previewPrefix, "preview-prefix", preview.DefaultPrefix,
+		"The prefix of the preview layer names, followed by the pull request number.")
+	flag.StringVar(&previewSecretFile, "preview-secret-file", "",
+		"A file holding the secret pull request events are signed with (GitHub) or carry (GitLab). "+
+			"Required to receive pull request events.")
 	opts := zap.Options{
 		Development: true,
 		TimeEncoder: zapcore.ISO8601TimeEncoder,
@@ -122,8 +173,17 @@ func main() {
 		metricsServerOptions.FilterProvider = filters.WithAuthenticationAndAuthorization
 	}
 
+	cacheOptions := cache.Options{}
+	if remoteClustersNamespace != "" {
+		// only the Secrets of the remote clusters are needed, don't cache every Secret in the cluster.
+		cacheOptions.ByObject = map[client.Object]cache.ByObject{
+			&corev1.Secret{}: {Namespaces: map[string]cache.Config{remoteClustersNamespace: {}}},
+		}
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
+		Cache:                  cacheOptions,
 		Metrics:                metricsServerOptions,
 		WebhookServer:          webhookServer,
 		HealthProbeBindAddress: probeAddr,
@@ -146,15 +206,106 @@ func main() {
 		os.Exit(1)
 	}
 
+	var remotes *remote.Clusters
+	if remoteClustersNamespace != "" {
+		remotes = &remote.Clusters{Reader: mgr.GetClient(), Namespace: remoteClustersNamespace, Scheme: mgr.GetScheme()}
+	}
+
+	var metrics analysis.Querier
+	if prometheusURL != "" {
+		metrics = &analysis.Prometheus{URL: prometheusURL}
+	}
 	if err = (&controller.LayerReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		IstioEnabled:  enableIstio,
+		LayerHeader:   layerHeader,
+		RootNamespace: rootNamespace,
+		Metrics:       metrics,
+		ClusterDomain: clusterDomain,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Layer")
+		os.Exit(1)
+	}
+	if err = (&controller.LayerServiceReconciler{
+		Client:            mgr.GetClient(),
+		Scheme:            mgr.GetScheme(),
+		IstioEnabled:      enableIstio,
+		LayerHeader:       layerHeader,
+		ClusterDomain:     clusterDomain,
+		SnapshotRevisions: snapshotRevisions,
+		AccessLogProvider: accessLogProvider,
+		Remotes:           remotes,
+		EgressGateway:     egressGateway,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "LayerService")
+		os.Exit(1)
+	}
+	if err = (&controller.NamespaceLayerReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		IstioEnabled:  enableIstio,
+		LayerHeader:   layerHeader,
+		ClusterDomain: clusterDomain,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "NamespaceLayer")
+		os.Exit(1)
+	}
+	if err = (&controller.RouteRollbackReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Layer")
+		setupLog.Error(err, "unable to create controller", "controller", "RouteRollback")
+		os.Exit(1)
+	}
+	if err = (&controller.IngressPolicyReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		IstioEnabled:  enableIstio,
+		LayerHeader:   layerHeader,
+		RootNamespace: rootNamespace,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "IngressPolicy")
+		os.Exit(1)
+	}
+	if err = (&controller.LayerPromotionReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		ClusterDomain: clusterDomain,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "LayerPromotion")
 		os.Exit(1)
 	}
 	// +kubebuilder:scaffold:builder
 
+	if previewAddr != "0" {
+		if previewTemplate == "" {
+			setupLog.Error(nil, "--preview-template is required to receive pull request events")
+			os.Exit(1)
+		}
+		if previewSecretFile == "" {
+			setupLog.Error(nil, "--preview-secret-file is required to receive pull request events")
+			os.Exit(1)
+		}
+		secret, err := os.ReadFile(previewSecretFile)
+		if err != nil {
+			setupLog.Error(err, "unable to read preview secret")
+			os.Exit(1)
+		}
+		secret = bytes.TrimSpace(secret)
+		if err = mgr.Add(&preview.Receiver{
+			Client:   mgr.GetClient(),
+			Addr:     previewAddr,
+			Template: previewTemplate,
+			Parent:   previewParent,
+			Prefix:   previewPrefix,
+			Secret:   secret,
+		}); err != nil {
+			setupLog.Error(err, "unable to add preview receiver")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -0,0 +1,119 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package analysis compares the requests entering a layer with those of the default route,
+// using the istio request metrics labelled with the layer by the generated Telemetry.
+package analysis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fergalsomers/routelayer/internal/routing"
+)
+
+// DefaultWindow is the range of the rates compared.
+const DefaultWindow = "5m"
+
+// Thresholds define how much worse a layer's requests may be than the default route's.
+type Thresholds struct {
+	// Window - range of the rates compared, a prometheus duration.
+	Window string
+	// MaxErrorRateIncrease - percentage points by which the layer's 5xx rate may exceed the default route's.
+	MaxErrorRateIncrease float64
+	// MaxLatencyIncrease - percent by which the layer's p95 latency may exceed the default route's.
+	MaxLatencyIncrease float64
+}
+
+// Result of comparing a layer with the default route. Error rates are percentages, latencies milliseconds.
+type Result struct {
+	// Traffic is false when no requests entered the layer during the window, nothing else is set.
+	Traffic          bool
+	ErrorRate        float64
+	DefaultErrorRate float64
+	Latency          float64
+	DefaultLatency   float64
+	// Degraded is true when either threshold was exceeded, Reasons says how.
+	Degraded bool
+	Reasons  []string
+}
+
+// Analyze compares the requests which entered layer during the window with those which selected no layer.
+func Analyze(ctx context.Context, q Querier, layer string, t Thresholds) (Result, error) {
+	if t.Window == "" {
+		t.Window = DefaultWindow
+	}
+	res := Result{}
+
+	errorRate, ok, err := q.Query(ctx, ErrorRateQuery(layer, t.Window))
+	if err != nil || !ok {
+		return res, err
+	}
+	res.Traffic = true
+	res.ErrorRate = errorRate
+	if res.DefaultErrorRate, _, err = q.Query(ctx, ErrorRateQuery(routing.DefaultLayerTagValue, t.Window)); err != nil {
+		return res, err
+	}
+	if res.ErrorRate-res.DefaultErrorRate > t.MaxErrorRateIncrease {
+		res.Degraded = true
+		res.Reasons = append(res.Reasons, fmt.Sprintf("5xx rate %.2f%% exceeds the default route's %.2f%% by more than %g points",
+			res.ErrorRate, res.DefaultErrorRate, t.MaxErrorRateIncrease))
+	}
+
+	if res.Latency, _, err = q.Query(ctx, LatencyQuery(layer, t.Window)); err != nil {
+		return res, err
+	}
+	defaultLatency, ok, err := q.Query(ctx, LatencyQuery(routing.DefaultLayerTagValue, t.Window))
+	if err != nil {
+		return res, err
+	}
+	res.DefaultLatency = defaultLatency
+	// without requests to the default route there is no latency to compare with.
+	if ok && res.Latency > res.DefaultLatency*(1+t.MaxLatencyIncrease/100) {
+		res.Degraded = true
+		res.Reasons = append(res.Reasons, fmt.Sprintf("p95 latency %.0fms exceeds the default route's %.0fms by more than %g%%",
+			res.Latency, res.DefaultLatency, t.MaxLatencyIncrease))
+	}
+	return res, nil
+}
+
+// Message describes the result.
+func (r Result) Message() string {
+	if r.Degraded {
+		return strings.Join(r.Reasons, "; ")
+	}
+	return fmt.Sprintf("5xx rate %.2f%% (default route %.2f%%), p95 latency %.0fms (default route %.0fms)",
+		r.ErrorRate, r.DefaultErrorRate, r.Latency, r.DefaultLatency)
+}
+
+// ErrorRateQuery returns the percentage of requests entering layer which failed with a 5xx, as reported by
+// their clients. It has no value when there were no requests.
+func ErrorRateQuery(layer, window string) string {
+	selector := requestSelector(layer)
+	return fmt.Sprintf(`100 * (sum(rate(istio_requests_total{%s,response_code=~"5.."}[%s])) or vector(0)) / sum(rate(istio_requests_total{%s}[%s]))`,
+		selector, window, selector, window)
+}
+
+// LatencyQuery returns the p95 latency, in milliseconds, of the requests entering layer.
+func LatencyQuery(layer, window string) string {
+	return fmt.Sprintf(`histogram_quantile(0.95, sum by (le) (rate(istio_request_duration_milliseconds_bucket{%s}[%s])))`,
+		requestSelector(layer), window)
+}
+
+func requestSelector(layer string) string {
+	return fmt.Sprintf(`reporter="source",%s=%q`, routing.LayerMetricTag, layer)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package analysis
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakePrometheus answers each query with the value given for it, and an empty vector for any other.
+func fakePrometheus(values map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Expect(r.URL.Path).To(Equal("/api/v1/query"))
+		result := "[]"
+		if v, ok := values[r.URL.Query().Get("query")]; ok {
+			result = fmt.Sprintf(`[{"metric":{},"value":[1718000000,%q]}]`, v)
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":%s}}`, result)
+	}))
+}
+
+var _ = Describe("Prometheus", func() {
+	ctx := context.Background()
+
+	It("should return the value of the first sample", func() {
+		server := fakePrometheus(map[string]string{"up": "0.25"})
+		defer server.Close()
+
+		p := &Prometheus{URL: server.URL + "/"}
+		value, ok, err := p.Query(ctx, "up")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal(0.25))
+
+		_, ok, err = p.Query(ctx, "down")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should have no value for NaN", func() {
+		server := fakePrometheus(map[string]string{"up": "NaN"})
+		defer server.Close()
+
+		_, ok, err := (&Prometheus{URL: server.URL}).Query(ctx, "up")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should return query errors", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+		}))
+		defer server.Close()
+
+		_, _, err := (&Prometheus{URL: server.URL}).Query(ctx, "up{")
+		Expect(err).To(MatchError(ContainSubstring("parse error")))
+	})
+})
+
+var _ = Describe("Analyze", func() {
+	ctx := context.Background()
+	thresholds := Thresholds{MaxErrorRateIncrease: 5, MaxLatencyIncrease: 50}
+
+	analyze := func(values map[string]string) Result {
+		server := fakePrometheus(values)
+		defer server.Close()
+		res, err := Analyze(ctx, &Prometheus{URL: server.URL}, "v2", thresholds)
+		Expect(err).NotTo(HaveOccurred())
+		return res
+	}
+
+	It("should find no traffic without requests in the layer", func() {
+		Expect(analyze(map[string]string{}).Traffic).To(BeFalse())
+	})
+
+	It("should be healthy within the thresholds", func() {
+		res := analyze(map[string]string{
+			ErrorRateQuery("v2", "5m"):      "6",
+			ErrorRateQuery("default", "5m"): "2",
+			LatencyQuery("v2", "5m"):        "140",
+			LatencyQuery("default", "5m"):   "100",
+		})
+		Expect(res.Traffic).To(BeTrue())
+		Expect(res.Degraded).To(BeFalse())
+		Expect(res.Message()).To(Equal("5xx rate 6.00% (default route 2.00%), p95 latency 140ms (default route 100ms)"))
+	})
+
+	It("should be degraded by errors or latency", func() {
+		res := analyze(map[string]string{
+			ErrorRateQuery("v2", "5m"):      "8",
+			ErrorRateQuery("default", "5m"): "2",
+			LatencyQuery("v2", "5m"):        "160",
+			LatencyQuery("default", "5m"):   "100",
+		})
+		Expect(res.Degraded).To(BeTrue())
+		Expect(res.Reasons).To(HaveLen(2))
+		Expect(res.Reasons[0]).To(HavePrefix("5xx rate 8.00%"))
+		Expect(res.Reasons[1]).To(HavePrefix("p95 latency 160ms"))
+	})
+
+	It("should not compare latency without requests to the default route", func() {
+		res := analyze(map[string]string{
+			ErrorRateQuery("v2", "5m"): "0",
+			LatencyQuery("v2", "5m"):   "900",
+		})
+		Expect(res.Degraded).To(BeFalse())
+	})
+})
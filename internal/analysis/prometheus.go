@@ -0,0 +1,112 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package analysis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Querier runs instant PromQL queries returning a single value.
+// ok is false when the query has no value, e.g. there were no requests to take a rate of.
+type Querier interface {
+	Query(ctx context.Context, query string) (value float64, ok bool, err error)
+}
+
+// Prometheus queries the HTTP API of Prometheus, or anything compatible with it (Thanos, Mimir, VictoriaMetrics).
+type Prometheus struct {
+	// URL of the API, without the /api/v1 path, e.g. http://prometheus.istio-system:9090.
+	URL string
+	// Client makes the requests, one giving up after DefaultTimeout when nil.
+	Client *http.Client
+}
+
+// DefaultTimeout bounds a query when no Client is given, so an unresponsive Prometheus can't hold up a reconcile.
+const DefaultTimeout = 30 * time.Second
+
+var defaultClient = &http.Client{Timeout: DefaultTimeout}
+
+// Query returns the value of the first sample of a vector result, or of a scalar result.
+func (p *Prometheus) Query(ctx context.Context, query string) (float64, bool, error) {
+	u := strings.TrimSuffix(p.URL, "/") + "/api/v1/query?" + url.Values{"query": {query}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	c := p.Client
+	if c == nil {
+		c = defaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, false, fmt.Errorf("query %q: %s: %w", query, resp.Status, err)
+	}
+	if body.Status != "success" {
+		return 0, false, fmt.Errorf("query %q: %s", query, body.Error)
+	}
+
+	var sample [2]interface{}
+	switch body.Data.ResultType {
+	case "scalar":
+		if err := json.Unmarshal(body.Data.Result, &sample); err != nil {
+			return 0, false, err
+		}
+	case "vector":
+		var vector []struct {
+			Value [2]interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(body.Data.Result, &vector); err != nil {
+			return 0, false, err
+		}
+		if len(vector) == 0 {
+			return 0, false, nil
+		}
+		sample = vector[0].Value
+	default:
+		return 0, false, fmt.Errorf("query %q: unexpected %s result", query, body.Data.ResultType)
+	}
+
+	s, _ := sample[1].(string)
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("query %q: %w", query, err)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false, nil
+	}
+	return value, true, nil
+}
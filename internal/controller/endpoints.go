@@ -0,0 +1,88 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+	"github.com/fergalsomers/routelayer/internal/routing"
+)
+
+// +kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+// endpointsReady returns whether a normalized LayerService has a ready endpoint, in any of the clusters, to serve it:
+// an endpoint of its destination service (or its host's, when it has none) which, when it has labels, is a pod
+// with them. Destinations outside the cluster can't be checked, so are taken to be ready.
+func endpointsReady(ctx context.Context, clusters []client.Client, ls routelayerv1.LayerService, domain string) (bool, error) {
+	for _, c := range clusters {
+		ready, err := clusterEndpointsReady(ctx, c, ls, domain)
+		if err != nil || ready {
+			return ready, err
+		}
+	}
+	return false, nil
+}
+
+func clusterEndpointsReady(ctx context.Context, c client.Client, ls routelayerv1.LayerService, domain string) (bool, error) {
+	service := ls.Spec.Destination
+	if service == "" {
+		service = ls.Spec.Host
+	}
+	namespace, ok := routing.HostNamespace(service, domain)
+	if !ok {
+		return true, nil
+	}
+	name, _, _ := strings.Cut(service, ".")
+
+	var pods map[string]bool
+	if len(ls.Spec.Labels) > 0 {
+		list := &corev1.PodList{}
+		if err := c.List(ctx, list, client.InNamespace(namespace), client.MatchingLabels(ls.Spec.Labels)); err != nil {
+			return false, err
+		}
+		pods = map[string]bool{}
+		for _, pod := range list.Items {
+			pods[pod.Name] = true
+		}
+	}
+
+	endpointSlices := &discoveryv1.EndpointSliceList{}
+	if err := c.List(ctx, endpointSlices, client.InNamespace(namespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: name}); err != nil {
+		return false, err
+	}
+	for _, slice := range endpointSlices.Items {
+		for _, ep := range slice.Endpoints {
+			// a nil ready condition is to be taken as ready.
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			if pods != nil && (ep.TargetRef == nil || ep.TargetRef.Kind != "Pod" || !pods[ep.TargetRef.Name]) {
+				continue
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	controllerutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+	"github.com/fergalsomers/routelayer/internal/routing"
+	"github.com/go-logr/logr"
+)
+
+// IngressPolicyReconciler reconciles a IngressPolicy object
+type IngressPolicyReconciler struct {
+	client.Client
+	Scheme       *runtime.Scheme
+	IstioEnabled bool // Whether integration with istio should be enabled or not. Defaults to false.
+	// LayerHeader is the request header used to select a layer. Defaults to routing.DefaultLayerHeader.
+	LayerHeader string
+	// RootNamespace is the istio root namespace, where the filters for the ingress gateways are generated.
+	// Defaults to routing.DefaultRootNamespace.
+	RootNamespace string
+}
+
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=ingresspolicies,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=ingresspolicies/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=ingresspolicies/finalizers,verbs=update
+// +kubebuilder:rbac:groups=networking.istio.io,resources=envoyfilters,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=security.istio.io,resources=requestauthentications,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=layers;namespacelayers,verbs=get;list;watch
+
+// Reconcile generates the EnvoyFilter removing the layer header from requests entering through the ingress
+// gateways which the IngressPolicy does not allow to select a layer.
+func (r *IngressPolicyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	log := logger.WithValues("ingresspolicy", req.NamespacedName)
+
+	policy := &routelayerv1.IngressPolicy{}
+	if err := r.Get(ctx, req.NamespacedName, policy); err != nil {
+		log.Error(err, "unable to fetch IngressPolicy")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if policy.ObjectMeta.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(policy, RouteLayerFinalizer) {
+			controllerutil.AddFinalizer(policy, RouteLayerFinalizer)
+			if err := r.Update(ctx, policy); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	} else {
+		if controllerutil.ContainsFinalizer(policy, RouteLayerFinalizer) {
+			if err := r.deleteIngressPolicy(ctx, policy, log); err != nil {
+				return ctrl.Result{}, err
+			}
+			controllerutil.RemoveFinalizer(policy, RouteLayerFinalizer)
+			if err := r.Update(ctx, policy); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+
+	cntrl, err := r.createUpdateIngressPolicy(ctx, policy, log)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.Status().Update(ctx, policy); err != nil {
+		return ctrl.Result{}, err
+	}
+	return cntrl, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// The filters remove the entry cookies and query parameters of every layer, so changes to layers' specs requeue
+// the IngressPolicies.
+func (r *IngressPolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&routelayerv1.IngressPolicy{}).
+		Watches(&routelayerv1.Layer{}, handler.EnqueueRequestsFromMapFunc(r.allPolicies),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&routelayerv1.NamespaceLayer{}, handler.EnqueueRequestsFromMapFunc(r.allPolicies),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Named("ingresspolicy").
+		Complete(r)
+}
+
+func (r *IngressPolicyReconciler) allPolicies(ctx context.Context, _ client.Object) []reconcile.Request {
+	list := &routelayerv1.IngressPolicyList{}
+	if err := r.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list IngressPolicies")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, p := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: p.Name}})
+	}
+	return requests
+}
+
+// layerEntry returns how requests select the Layers and NamespaceLayers, other than by the layer header.
+func (r *IngressPolicyReconciler) layerEntry(ctx context.Context) (routing.IngressEntry, error) {
+	entry := routing.IngressEntry{}
+	layers := &routelayerv1.LayerList{}
+	if err := r.List(ctx, layers); err != nil {
+		return entry, err
+	}
+	for _, l := range layers.Items {
+		entry.Add(l.Name, l.Spec)
+	}
+	namespaceLayers := &routelayerv1.NamespaceLayerList{}
+	if err := r.List(ctx, namespaceLayers); err != nil {
+		return entry, err
+	}
+	for _, nl := range namespaceLayers.Items {
+		entry.Add(nl.Name, nl.Spec)
+	}
+	return entry, nil
+}
+
+func (r *IngressPolicyReconciler) createUpdateIngressPolicy(ctx context.Context, policy *routelayerv1.IngressPolicy, log logr.Logger) (ctrl.Result, error) {
+	log.Info("create/update ingresspolicy")
+
+	if msg := validateIngressPolicy(policy); msg != "" {
+		policy.Status.Message = msg
+		policy.Status.State = ErrorState
+		return ctrl.Result{}, nil
+	}
+
+	if !r.IstioEnabled {
+		policy.Status.Message = "Istio is not enabled, the layer header is not removed at ingress"
+		policy.Status.State = WaitingState
+		return ctrl.Result{}, nil
+	}
+
+	entry, err := r.layerEntry(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	ef, err := routing.IngressEnvoyFilter(policy, r.rootNamespace(), r.layerHeader(), entry)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if ra := routing.IngressRequestAuthentication(policy, r.rootNamespace()); ra != nil {
+		if err := r.apply(ctx, ra); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if err := r.deleteIfExists(ctx, routing.NewRequestAuthentication(routing.IngressName(policy.Name), r.rootNamespace())); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.apply(ctx, ef); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	policy.Status.Message = fmt.Sprintf("Layer header removed at ingress unless one of %d rules allows it", len(policy.Spec.Allow))
+	policy.Status.State = ReadyState
+
+	log.Info("ingresspolicy", "resourceVersion", policy.ObjectMeta.ResourceVersion, "state", policy.Status.State)
+
+	return ctrl.Result{}, nil
+}
+
+func (r *IngressPolicyReconciler) deleteIngressPolicy(ctx context.Context, policy *routelayerv1.IngressPolicy, log logr.Logger) error {
+	log.Info("deleting ingresspolicy")
+	if !r.IstioEnabled {
+		return nil
+	}
+	name := routing.IngressName(policy.Name)
+	for _, obj := range []*unstructured.Unstructured{
+		routing.NewEnvoyFilter(name, r.rootNamespace()),
+		routing.NewRequestAuthentication(name, r.rootNamespace()),
+	} {
+		if err := r.deleteIfExists(ctx, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateIngressPolicy checks every rule allows something and its IP blocks can be matched.
+func validateIngressPolicy(policy *routelayerv1.IngressPolicy) string {
+	for i, rule := range policy.Spec.Allow {
+		if len(rule.IPBlocks) == 0 && rule.JWT == nil {
+			return fmt.Sprintf("Allow rule %d must have ipBlocks or a jwt", i)
+		}
+		for _, block := range rule.IPBlocks {
+			if _, err := routing.ParseIPBlock(block); err != nil {
+				return fmt.Sprintf("Allow rule %d: %v", i, err)
+			}
+		}
+	}
+	return ""
+}
+
+func (r *IngressPolicyReconciler) apply(ctx context.Context, obj *unstructured.Unstructured) error {
+	return r.Patch(ctx, obj, client.Apply, client.FieldOwner(routing.FieldManager), client.ForceOwnership)
+}
+
+func (r *IngressPolicyReconciler) deleteIfExists(ctx context.Context, obj *unstructured.Unstructured) error {
+	return client.IgnoreNotFound(r.Delete(ctx, obj))
+}
+
+func (r *IngressPolicyReconciler) layerHeader() string {
+	if r.LayerHeader == "" {
+		return routing.DefaultLayerHeader
+	}
+	return r.LayerHeader
+}
+
+func (r *IngressPolicyReconciler) rootNamespace() string {
+	if r.RootNamespace == "" {
+		return routing.DefaultRootNamespace
+	}
+	return r.RootNamespace
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+var _ = Describe("IngressPolicy Reconciler", func() {
+	Context("When reconciling an IngressPolicy", func() {
+		const resourceName = "test-ingresspolicy"
+
+		ctx := context.Background()
+
+		namespacedName := types.NamespacedName{Name: resourceName}
+
+		var policy *routelayerv1.IngressPolicy
+
+		reconcile := func() *routelayerv1.IngressPolicy {
+			rc := &IngressPolicyReconciler{Client: k8sClient}
+			_, err := rc.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			p := &routelayerv1.IngressPolicy{}
+			Expect(k8sClient.Get(ctx, namespacedName, p)).To(Succeed())
+			return p
+		}
+
+		BeforeEach(func() {
+			policy = &routelayerv1.IngressPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName},
+				Spec: routelayerv1.IngressPolicySpec{
+					Allow: []routelayerv1.IngressAllowRule{{IPBlocks: []string{"10.0.0.0/8"}}},
+				},
+			}
+		})
+
+		AfterEach(func() {
+			Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			rc := &IngressPolicyReconciler{Client: k8sClient}
+			_, err := rc.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("IngressPolicy without istio should be waiting", func() {
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+
+			p := reconcile()
+			Expect(p.Status.State).To(Equal(WaitingState))
+		})
+
+		It("IngressPolicy with an IPv6 block should be in error", func() {
+			policy.Spec.Allow[0].IPBlocks = []string{"fd00::/8"}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+
+			p := reconcile()
+			Expect(p.Status.State).To(Equal(ErrorState))
+		})
+
+		It("IngressPolicy with a rule allowing nothing should be in error", func() {
+			policy.Spec.Allow = append(policy.Spec.Allow, routelayerv1.IngressAllowRule{})
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+
+			p := reconcile()
+			Expect(p.Status.State).To(Equal(ErrorState))
+		})
+	})
+})
@@ -19,16 +19,31 @@ package controller
 import (
 	"context"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	controllerutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+	"github.com/fergalsomers/routelayer/internal/analysis"
+	"github.com/fergalsomers/routelayer/internal/routing"
 	"github.com/go-logr/logr"
 )
 
@@ -37,6 +52,15 @@ type LayerReconciler struct {
 	client.Client
 	Scheme       *runtime.Scheme
 	IstioEnabled bool // Whether integration with istio should be enabled or not. Defaults to false.
+	// LayerHeader is the request header used to select a layer. Defaults to routing.DefaultLayerHeader.
+	LayerHeader string
+	// RootNamespace is the istio root namespace, where access policies for cluster Layers are generated.
+	// Defaults to routing.DefaultRootNamespace.
+	RootNamespace string
+	// Metrics is queried to analyze the layers which ask for it, no analysis is done when nil.
+	Metrics analysis.Querier
+	// ClusterDomain is the DNS domain of the cluster, used to normalize hosts. Defaults to routing.DefaultClusterDomain.
+	ClusterDomain string
 }
 
 const (
@@ -45,11 +69,30 @@ const (
 	WaitingState        = "Waiting"
 	ReadyState          = "Ready"
 	ErrorState          = "Error"
+	PausedState         = "Paused"
+	SuspendedState      = "Suspended"
+	// ConflictCondition is true when a VirtualService not generated by routelayer already routes the host.
+	ConflictCondition = "Conflict"
+	// DriftedCondition is true when someone else changed a generated resource, and routelayer put it back.
+	DriftedCondition = "Drifted"
+	// DegradedCondition is true when a layer's requests are worse than those of the default route.
+	DegradedCondition = "Degraded"
+	// EndpointsReadyCondition is true when a LayerService has a ready endpoint, it isn't routed until then.
+	EndpointsReadyCondition = "EndpointsReady"
+	// RemoteClustersCondition is true when a LayerService's host is routed in every remote cluster of the mesh.
+	RemoteClustersCondition = "RemoteClustersSynced"
+	// TemplateLabel marks the LayerServices stamped out from a layer's template, its value is the layer.
+	TemplateLabel = "routelayer.github.com/template-of"
 )
 
 // +kubebuilder:rbac:groups=routelayer.github.com,resources=layers,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=routelayer.github.com,resources=layers/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=routelayer.github.com,resources=layers/finalizers,verbs=update
+// +kubebuilder:rbac:groups=security.istio.io,resources=authorizationpolicies;requestauthentications,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=layertemplates,verbs=get;list;watch
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=layerservices,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=namespacelayers,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -128,15 +171,49 @@ func (r *LayerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 }
 
 // SetupWithManager sets up the controller with the Manager.
+// Layers are requeued when their template changes. A layer's status aggregates its LayerServices', so they requeue
+// their layer too - the LayerServices stamped out from its template among them - as do the Deployments it clones.
+// The access of a layer restricts the layers beneath it, so changes to their specs requeue the restricted Layers.
 func (r *LayerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&routelayerv1.Layer{}).
+		Owns(&appsv1.Deployment{}).
+		Watches(&routelayerv1.LayerService{}, handler.EnqueueRequestsFromMapFunc(r.serviceLayer)).
+		Watches(&routelayerv1.LayerTemplate{}, handler.EnqueueRequestsFromMapFunc(r.templateLayers)).
+		Watches(&routelayerv1.Layer{}, handler.EnqueueRequestsFromMapFunc(r.restrictedLayers),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&routelayerv1.NamespaceLayer{}, handler.EnqueueRequestsFromMapFunc(r.restrictedLayers),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Named("layer").
 		Complete(r)
 }
 
+func (r *LayerReconciler) templateLayers(ctx context.Context, obj client.Object) []reconcile.Request {
+	list := &routelayerv1.LayerList{}
+	if err := r.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list Layers")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, l := range list.Items {
+		if l.Spec.Template != nil && l.Spec.Template.Name == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: l.Name}})
+		}
+	}
+	return requests
+}
+
+func (r *LayerReconciler) serviceLayer(_ context.Context, obj client.Object) []reconcile.Request {
+	ls, ok := obj.(*routelayerv1.LayerService)
+	if !ok || ls.Spec.Layer == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: ls.Spec.Layer}}}
+}
+
 const (
-	defaultWait = time.Second * 60
+	defaultWait             = time.Second * 60
+	defaultAnalysisInterval = time.Minute
 )
 
 func (r *LayerReconciler) createUpdateLayer(ctx context.Context, layer *routelayerv1.Layer, log logr.Logger) (ctrl.Result, error) {
@@ -159,8 +236,80 @@ func (r *LayerReconciler) createUpdateLayer(ctx context.Context, layer *routelay
 		}
 	}
 
+	if state, msg, err := r.stampTemplate(ctx, layer); err != nil || msg != "" {
+		layer.Status.Message = msg
+		layer.Status.State = state
+		return ctrl.Result{}, err
+	}
+
+	if msg := validateAccess(layer.Spec.Access); msg != "" {
+		layer.Status.Message = msg
+		layer.Status.State = ErrorState
+		return ctrl.Result{}, nil
+	}
+
+	if msg := validateEnrollment(layer.Name, layer.Spec.Enrollment); msg != "" {
+		layer.Status.Message = msg
+		layer.Status.State = ErrorState
+		return ctrl.Result{}, nil
+	}
+
+	shadowed, err := r.shadowedNamespaces(ctx, layer.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	belongs := func(ls routelayerv1.LayerService) bool { return !shadowed[ls.Namespace] }
+
+	// The policy applies to the whole mesh, the JWT is validated at the ingress gateways and where the layer, or
+	// the layers inheriting its routes, route.
 	if r.IstioEnabled {
-		// do some istio stufff
+		inheriting, err := r.inheritingLayers(ctx, layer.Name)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := reconcileAccess(ctx, r.Client, layer.Name, inheriting, r.rootNamespace(), r.layerHeader(),
+			routing.DefaultIngressSelector, layer.Spec.Access); err != nil {
+			return ctrl.Result{}, err
+		}
+		namespaces, err := routedNamespaces(ctx, r.Client, r.clusterDomain(), func(ls routelayerv1.LayerService) bool {
+			if ls.Spec.Layer == layer.Name {
+				return belongs(ls)
+			}
+			return slices.Contains(inheriting, ls.Spec.Layer)
+		})
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.reconcileAuthentication(ctx, layer.Name, namespaces, layer.Spec.Access); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	result := ctrl.Result{}
+	if layer.Spec.Analysis != nil && r.Metrics != nil && !layer.Spec.Suspend {
+		interval, err := r.analyze(ctx, layer, log)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		result.RequeueAfter = interval
+	}
+
+	notReady, err := aggregateServices(ctx, r.Client, r.clusterDomain(), layer.Name, belongs, &layer.Status)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if layer.Spec.Suspend {
+		layer.Status.Message = "Layer suspended, its LayerServices are not routed"
+		layer.Status.State = SuspendedState
+		return ctrl.Result{}, nil
+	}
+
+	if len(notReady) > 0 {
+		layer.Status.Message = fmt.Sprintf("%d of %d LayerServices ready: %s",
+			layer.Status.ReadyServices, layer.Status.Services, strings.Join(notReady, "; "))
+		layer.Status.State = WaitingState
+		return result, nil
 	}
 
 	layer.Status.Message = "Layer created"
@@ -168,10 +317,566 @@ func (r *LayerReconciler) createUpdateLayer(ctx context.Context, layer *routelay
 
 	log.Info("layer", "resourceVersion", layer.ObjectMeta.ResourceVersion, "state", layer.Status.State)
 
-	return ctrl.Result{}, nil
+	return result, nil
+}
+
+// analyze compares the layer's requests with the default route's and sets the Degraded condition,
+// suspending the layer if it is degraded and asks for it. It returns when to analyze the layer again.
+// The layer is reconciled whenever its status changes, so it is only analyzed once the interval since the last
+// analysis has passed, or its spec has changed.
+// The metrics being unavailable is reported in the condition, it doesn't stop the layer being routed.
+func (r *LayerReconciler) analyze(ctx context.Context, layer *routelayerv1.Layer, log logr.Logger) (time.Duration, error) {
+	spec := layer.Spec.Analysis
+	interval := defaultAnalysisInterval
+	if spec.Interval != nil && spec.Interval.Duration > 0 {
+		interval = spec.Interval.Duration
+	}
+	now := time.Now()
+	if last := layer.Status.LastAnalysisTime; last != nil {
+		c := meta.FindStatusCondition(layer.Status.Conditions, DegradedCondition)
+		if due := last.Add(interval); now.Before(due) && c != nil && c.ObservedGeneration == layer.Generation {
+			return due.Sub(now), nil
+		}
+	}
+	layer.Status.LastAnalysisTime = &metav1.Time{Time: now}
+
+	res, err := analysis.Analyze(ctx, r.Metrics, layer.Name, analysis.Thresholds{
+		Window:               spec.Window,
+		MaxErrorRateIncrease: float64(spec.MaxErrorRateIncrease),
+		MaxLatencyIncrease:   float64(spec.MaxLatencyIncrease),
+	})
+	condition := metav1.Condition{
+		Type:               DegradedCondition,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Healthy",
+		Message:            res.Message(),
+		ObservedGeneration: layer.Generation,
+	}
+	switch {
+	case err != nil:
+		log.Error(err, "unable to analyze layer")
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "AnalysisFailed"
+		condition.Message = err.Error()
+	case !res.Traffic:
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "NoTraffic"
+		condition.Message = "No requests entered the layer"
+	case res.Degraded:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "ThresholdExceeded"
+	}
+
+	if err == nil && res.Degraded && spec.AutoSuspend {
+		// patching the spec returns the stored status, keep the one being reconciled.
+		status := layer.Status.DeepCopy()
+		patch := client.MergeFrom(layer.DeepCopy())
+		layer.Spec.Suspend = true
+		if err := r.Patch(ctx, layer, patch); err != nil {
+			return 0, err
+		}
+		layer.Status = *status
+		condition.Reason = "Suspended"
+		log.Info("layer degraded, suspended", "reasons", res.Reasons)
+	}
+	meta.SetStatusCondition(&layer.Status.Conditions, condition)
+	return interval, nil
+}
+
+// inheritingLayers returns the names of the Layers and NamespaceLayers beneath the layer, whose requests fall back
+// to its routes.
+func (r *LayerReconciler) inheritingLayers(ctx context.Context, layer string) ([]string, error) {
+	layers := &routelayerv1.LayerList{}
+	if err := r.List(ctx, layers); err != nil {
+		return nil, err
+	}
+	namespaceLayers := &routelayerv1.NamespaceLayerList{}
+	if err := r.List(ctx, namespaceLayers); err != nil {
+		return nil, err
+	}
+	beneath := map[string]bool{layer: true}
+	for found := true; found; {
+		found = false
+		for _, l := range layers.Items {
+			if beneath[l.Spec.Parent] && !beneath[l.Name] {
+				beneath[l.Name] = true
+				found = true
+			}
+		}
+	}
+	// a NamespaceLayer's parent is a cluster Layer, nothing is beneath it
+	for _, nl := range namespaceLayers.Items {
+		if beneath[nl.Spec.Parent] {
+			beneath[nl.Name] = true
+		}
+	}
+	delete(beneath, layer)
+	return sortedKeys(beneath), nil
+}
+
+// restrictedLayers requeues the Layers restricting access, when a layer which may inherit their routes changes.
+func (r *LayerReconciler) restrictedLayers(ctx context.Context, _ client.Object) []reconcile.Request {
+	list := &routelayerv1.LayerList{}
+	if err := r.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list Layers")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, l := range list.Items {
+		if l.Spec.Access != nil {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: l.Name}})
+		}
+	}
+	return requests
+}
+
+// shadowedNamespaces returns the namespaces where a NamespaceLayer replaces the layer, their LayerServices
+// belong to that instead.
+func (r *LayerReconciler) shadowedNamespaces(ctx context.Context, layer string) (map[string]bool, error) {
+	list := &routelayerv1.NamespaceLayerList{}
+	if err := r.List(ctx, list); err != nil {
+		return nil, err
+	}
+	shadowed := map[string]bool{}
+	for _, nl := range list.Items {
+		if nl.Name == layer {
+			shadowed[nl.Namespace] = true
+		}
+	}
+	return shadowed, nil
+}
+
+// aggregateServices counts a layer's LayerServices, those for which belongs is true, and those of them ready to
+// serve traffic, and lists the hosts they override into its status. It returns why those not ready aren't.
+// A LayerService is only Ready once it has a ready endpoint, so its status says whether traffic can be served.
+func aggregateServices(ctx context.Context, c client.Client, domain, layer string,
+	belongs func(routelayerv1.LayerService) bool, status *routelayerv1.LayerStatus) ([]string, error) {
+	list := &routelayerv1.LayerServiceList{}
+	if err := c.List(ctx, list); err != nil {
+		return nil, err
+	}
+	var total, ready int32
+	hosts := map[string]bool{}
+	notReady := []string{}
+	for _, ls := range list.Items {
+		if ls.Spec.Layer != layer || !belongs(ls) || !ls.DeletionTimestamp.IsZero() {
+			continue
+		}
+		total++
+		n := routing.Normalize(ls, domain)
+		hosts[n.Spec.Host] = true
+		key := ls.Namespace + "/" + ls.Name
+		switch {
+		case ls.Status.State == ReadyState:
+			ready++
+		case ls.Status.State == "":
+			notReady = append(notReady, key+" is not reconciled yet")
+		default:
+			notReady = append(notReady, fmt.Sprintf("%s is %s: %s", key, ls.Status.State, ls.Status.Message))
+		}
+	}
+
+	status.Services = total
+	status.ReadyServices = ready
+	status.Hosts = sortedKeys(hosts)
+	return notReady, nil
 }
 
 func (r *LayerReconciler) deleteLayer(ctx context.Context, layer *routelayerv1.Layer, log logr.Logger) (ctrl.Result, error) {
 	log.Info("deleting layer")
+	if r.IstioEnabled {
+		if err := reconcileAccess(ctx, r.Client, layer.Name, nil, r.rootNamespace(), r.layerHeader(), nil, nil); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.reconcileAuthentication(ctx, layer.Name, nil, nil); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 	return ctrl.Result{}, nil
 }
+
+func (r *LayerReconciler) layerHeader() string {
+	if r.LayerHeader == "" {
+		return routing.DefaultLayerHeader
+	}
+	return r.LayerHeader
+}
+
+func (r *LayerReconciler) clusterDomain() string {
+	if r.ClusterDomain == "" {
+		return routing.DefaultClusterDomain
+	}
+	return r.ClusterDomain
+}
+
+func (r *LayerReconciler) rootNamespace() string {
+	if r.RootNamespace == "" {
+		return routing.DefaultRootNamespace
+	}
+	return r.RootNamespace
+}
+
+// stampTemplate creates or updates the LayerServices of the layer's template, and deletes those stamped out before
+// which it no longer has. A LayerService of the same name which wasn't stamped out from a template, e.g. one promoted
+// out of the layer, is left alone. When they can't be stamped out it returns the state and message to report.
+func (r *LayerReconciler) stampTemplate(ctx context.Context, layer *routelayerv1.Layer) (string, string, error) {
+	desired := []routelayerv1.LayerService{}
+	workloads := []workload{}
+	if layer.Spec.Template != nil {
+		tmpl := &routelayerv1.LayerTemplate{}
+		if err := r.Get(ctx, types.NamespacedName{Name: layer.Spec.Template.Name}, tmpl); err != nil {
+			if errors.IsNotFound(err) {
+				return WaitingState, fmt.Sprintf("LayerTemplate %s not found", layer.Spec.Template.Name), nil
+			}
+			return "", "", err
+		}
+		var msg string
+		if desired, workloads, msg = renderTemplate(layer, tmpl); msg != "" {
+			return ErrorState, msg, nil
+		}
+	}
+	if state, msg, err := r.stampWorkloads(ctx, layer, workloads); err != nil || msg != "" {
+		return state, msg, err
+	}
+
+	stamped := map[types.NamespacedName]bool{}
+	for _, d := range desired {
+		ls := &routelayerv1.LayerService{ObjectMeta: metav1.ObjectMeta{Name: d.Name, Namespace: d.Namespace}}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(ls), ls); err == nil && ls.Labels[TemplateLabel] == "" {
+			continue
+		} else if client.IgnoreNotFound(err) != nil {
+			return "", "", err
+		}
+		_, err := controllerutil.CreateOrUpdate(ctx, r.Client, ls, func() error {
+			if ls.Labels == nil {
+				ls.Labels = map[string]string{}
+			}
+			ls.Labels[TemplateLabel] = layer.Name
+			// the layer's own routelayer labels, e.g. the pull request of a preview layer, describe them too.
+			for k, v := range layer.Labels {
+				if strings.HasPrefix(k, "routelayer.github.com/") {
+					ls.Labels[k] = v
+				}
+			}
+			ls.Spec = d.Spec
+			return controllerutil.SetControllerReference(layer, ls, r.Scheme)
+		})
+		if err != nil {
+			if _, owned := err.(*controllerutil.AlreadyOwnedError); owned {
+				return ErrorState, fmt.Sprintf("LayerService %s/%s belongs to another Layer", d.Namespace, d.Name), nil
+			}
+			return "", "", err
+		}
+		stamped[client.ObjectKeyFromObject(ls)] = true
+	}
+
+	list := &routelayerv1.LayerServiceList{}
+	if err := r.List(ctx, list, client.MatchingLabels{TemplateLabel: layer.Name}); err != nil {
+		return "", "", err
+	}
+	for i := range list.Items {
+		if ls := &list.Items[i]; !stamped[client.ObjectKeyFromObject(ls)] {
+			if err := client.IgnoreNotFound(r.Delete(ctx, ls)); err != nil {
+				return "", "", err
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// workload is a Deployment to clone for a LayerService stamped out from a template.
+type workload struct {
+	namespace  string
+	deployment string
+	images     map[string]string // by container name
+	labels     map[string]string // of the LayerService, added to the clone's pods
+}
+
+// stampWorkloads creates or updates the clones of the workloads' Deployments, and deletes those cloned before which
+// are no longer wanted. A Deployment of the same name which wasn't cloned for a template is left alone.
+// When they can't be cloned it returns the state and message to report.
+func (r *LayerReconciler) stampWorkloads(ctx context.Context, layer *routelayerv1.Layer, workloads []workload) (string, string, error) {
+	stamped := map[types.NamespacedName]bool{}
+	for _, w := range workloads {
+		original := &appsv1.Deployment{}
+		if err := r.Get(ctx, types.NamespacedName{Name: w.deployment, Namespace: w.namespace}, original); err != nil {
+			if errors.IsNotFound(err) {
+				return WaitingState, fmt.Sprintf("Deployment %s/%s not found", w.namespace, w.deployment), nil
+			}
+			return "", "", err
+		}
+		spec, msg := cloneSpec(original, w)
+		if msg != "" {
+			return ErrorState, msg, nil
+		}
+
+		clone := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: w.deployment + "-" + layer.Name, Namespace: w.namespace}}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(clone), clone); err == nil {
+			if clone.Labels[TemplateLabel] == "" {
+				continue
+			}
+			if !equality.Semantic.DeepEqual(clone.Spec.Selector, spec.Selector) {
+				// the selector can't be changed, the clone is replaced.
+				if err := r.Delete(ctx, clone); err != nil {
+					return "", "", err
+				}
+				clone = &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: clone.Name, Namespace: clone.Namespace}}
+			}
+		} else if client.IgnoreNotFound(err) != nil {
+			return "", "", err
+		}
+		_, err := controllerutil.CreateOrUpdate(ctx, r.Client, clone, func() error {
+			if clone.Labels == nil {
+				clone.Labels = map[string]string{}
+			}
+			clone.Labels[TemplateLabel] = layer.Name
+			clone.Spec = *spec
+			return controllerutil.SetControllerReference(layer, clone, r.Scheme)
+		})
+		if err != nil {
+			if _, owned := err.(*controllerutil.AlreadyOwnedError); owned {
+				return ErrorState, fmt.Sprintf("Deployment %s/%s belongs to another Layer", clone.Namespace, clone.Name), nil
+			}
+			return "", "", err
+		}
+		stamped[client.ObjectKeyFromObject(clone)] = true
+	}
+
+	list := &appsv1.DeploymentList{}
+	if err := r.List(ctx, list, client.MatchingLabels{TemplateLabel: layer.Name}); err != nil {
+		return "", "", err
+	}
+	for i := range list.Items {
+		if d := &list.Items[i]; !stamped[client.ObjectKeyFromObject(d)] {
+			if err := client.IgnoreNotFound(r.Delete(ctx, d)); err != nil {
+				return "", "", err
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// cloneSpec returns the spec of the clone of the Deployment for the workload: its pods, and its selector, have the
+// LayerService's labels added, and its containers the images. Or a message saying why it can't be cloned.
+func cloneSpec(original *appsv1.Deployment, w workload) (*appsv1.DeploymentSpec, string) {
+	spec := original.Spec.DeepCopy()
+	if spec.Selector == nil {
+		spec.Selector = &metav1.LabelSelector{}
+	}
+	if spec.Selector.MatchLabels == nil {
+		spec.Selector.MatchLabels = map[string]string{}
+	}
+	if spec.Template.Labels == nil {
+		spec.Template.Labels = map[string]string{}
+	}
+	distinct := false
+	for k, v := range w.labels {
+		distinct = distinct || spec.Template.Labels[k] != v
+		spec.Selector.MatchLabels[k] = v
+		spec.Template.Labels[k] = v
+	}
+	if !distinct {
+		return nil, fmt.Sprintf("The labels of the LayerService cloning Deployment %s/%s select its own pods too",
+			original.Namespace, original.Name)
+	}
+	for _, name := range sortedKeys(w.images) {
+		i := slices.IndexFunc(spec.Template.Spec.Containers, func(c corev1.Container) bool { return c.Name == name })
+		j := slices.IndexFunc(spec.Template.Spec.InitContainers, func(c corev1.Container) bool { return c.Name == name })
+		switch {
+		case i >= 0:
+			spec.Template.Spec.Containers[i].Image = w.images[name]
+		case j >= 0:
+			spec.Template.Spec.InitContainers[j].Image = w.images[name]
+		default:
+			return nil, fmt.Sprintf("Deployment %s/%s has no container %s", original.Namespace, original.Name, name)
+		}
+	}
+	return spec, ""
+}
+
+// renderTemplate returns the LayerServices of the template for layer, and the workloads cloned for them, with
+// "${layer}" and "${<parameter>}" replaced, or a message saying why they can't be.
+func renderTemplate(layer *routelayerv1.Layer, tmpl *routelayerv1.LayerTemplate) ([]routelayerv1.LayerService, []workload, string) {
+	values := map[string]string{"layer": layer.Name}
+	for _, p := range tmpl.Spec.Parameters {
+		v, ok := layer.Spec.Template.Parameters[p.Name]
+		if !ok && p.Default == nil {
+			return nil, nil, fmt.Sprintf("Parameter %s of LayerTemplate %s must be set", p.Name, tmpl.Name)
+		}
+		if !ok {
+			v = *p.Default
+		}
+		values[p.Name] = v
+	}
+	for name := range layer.Spec.Template.Parameters {
+		if _, ok := values[name]; !ok || name == "layer" {
+			return nil, nil, fmt.Sprintf("LayerTemplate %s has no parameter %s", tmpl.Name, name)
+		}
+	}
+
+	oldnew := []string{}
+	for _, name := range sortedKeys(values) {
+		oldnew = append(oldnew, "${"+name+"}", values[name])
+	}
+	replacer := strings.NewReplacer(oldnew...)
+	unknown := ""
+	expand := func(s string) string {
+		s = replacer.Replace(s)
+		if strings.Contains(s, "${") && unknown == "" {
+			unknown = s
+		}
+		return s
+	}
+
+	services := []routelayerv1.LayerService{}
+	workloads := []workload{}
+	for _, st := range tmpl.Spec.Services {
+		ls := routelayerv1.LayerService{
+			ObjectMeta: metav1.ObjectMeta{Name: expand(st.Name), Namespace: expand(st.Namespace)},
+			Spec: routelayerv1.LayerServiceSpec{
+				Layer:          layer.Name,
+				Host:           expand(st.Spec.Host),
+				Destination:    expand(st.Spec.Destination),
+				DestinationTLS: st.Spec.DestinationTLS,
+				EgressGateway:  expand(st.Spec.EgressGateway),
+				Protocol:       st.Spec.Protocol,
+				Ports:          st.Spec.Ports,
+				Adopt:          st.Spec.Adopt,
+			},
+		}
+		if len(st.Spec.Labels) > 0 {
+			ls.Spec.Labels = map[string]string{}
+			for k, v := range st.Spec.Labels {
+				ls.Spec.Labels[k] = expand(v)
+			}
+		}
+		services = append(services, ls)
+		if st.Workload != nil {
+			if len(ls.Spec.Labels) == 0 {
+				return nil, nil, fmt.Sprintf("Service %s of LayerTemplate %s clones a Deployment, it must have labels "+
+					"to select the clone's pods", st.Name, tmpl.Name)
+			}
+			w := workload{
+				namespace:  ls.Namespace,
+				deployment: expand(st.Workload.Deployment),
+				images:     map[string]string{},
+				labels:     ls.Spec.Labels,
+			}
+			for name, image := range st.Workload.Images {
+				w.images[name] = expand(image)
+			}
+			workloads = append(workloads, w)
+		}
+	}
+	if unknown != "" {
+		return nil, nil, fmt.Sprintf("LayerTemplate %s refers to an unknown parameter in %q", tmpl.Name, unknown)
+	}
+	return services, workloads, ""
+}
+
+// validateAccess checks a layer's access allows something, an empty access would deny every request.
+func validateAccess(access *routelayerv1.LayerAccess) string {
+	if access != nil && len(access.Principals) == 0 && len(access.Namespaces) == 0 && access.JWT == nil {
+		return "Access must allow principals, namespaces or a jwt"
+	}
+	return ""
+}
+
+// validateEnrollment checks a layer's enrollment has a single hash key, which isn't its enrollment cookie.
+func validateEnrollment(layer string, e *routelayerv1.LayerEnrollment) string {
+	switch {
+	case e == nil:
+		return ""
+	case e.HashHeader != "" && e.HashCookie != "":
+		return "Enrollment may have a hashHeader or a hashCookie, not both"
+	case e.HashCookie != "" && e.HashCookie == routing.EnrollmentCookie(layer, e):
+		return "Enrollment hashCookie must not be its cookie"
+	}
+	return ""
+}
+
+// reconcileAccess generates the AuthorizationPolicy and RequestAuthentication restricting entry to layer, and the
+// layers inheriting its routes, in namespace, or deletes them if access is nil. The RequestAuthentication applies to the workloads the selector
+// matches, all of the namespace's if it is nil.
+func reconcileAccess(ctx context.Context, c client.Client, layer string, inheriting []string, namespace, header string,
+	selector map[string]string, access *routelayerv1.LayerAccess) error {
+	name := routing.AccessName(layer)
+	if access == nil {
+		for _, obj := range []*unstructured.Unstructured{
+			routing.NewAuthorizationPolicy(name, namespace),
+			routing.NewRequestAuthentication(name, namespace),
+		} {
+			if err := client.IgnoreNotFound(c.Delete(ctx, obj)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	apply := func(obj *unstructured.Unstructured) error {
+		return c.Patch(ctx, obj, client.Apply, client.FieldOwner(routing.FieldManager), client.ForceOwnership)
+	}
+	if ra := routing.RequestAuthentication(name, layer, namespace, selector, access); ra != nil {
+		if err := apply(ra); err != nil {
+			return err
+		}
+	} else if err := client.IgnoreNotFound(c.Delete(ctx, routing.NewRequestAuthentication(name, namespace))); err != nil {
+		return err
+	}
+	return apply(routing.AuthorizationPolicy(layer, inheriting, namespace, header, access))
+}
+
+// reconcileAuthentication generates the RequestAuthentication validating the JWT of the layer's access in each of
+// namespaces, and deletes those generated in other namespaces, all of them if the access has no JWT.
+func (r *LayerReconciler) reconcileAuthentication(ctx context.Context, layer string, namespaces []string,
+	access *routelayerv1.LayerAccess) error {
+	name := routing.ClusterAccessName(layer)
+	keep := map[string]bool{}
+	for _, namespace := range namespaces {
+		ra := routing.RequestAuthentication(name, layer, namespace, nil, access)
+		if ra == nil {
+			break
+		}
+		if err := r.Patch(ctx, ra, client.Apply, client.FieldOwner(routing.FieldManager), client.ForceOwnership); err != nil {
+			return err
+		}
+		keep[namespace] = true
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(routing.RequestAuthenticationGVK.GroupVersion().WithKind("RequestAuthenticationList"))
+	if err := r.List(ctx, list, client.MatchingLabels{routing.ManagedByLabel: routing.ManagedByValue}); err != nil {
+		return err
+	}
+	for i := range list.Items {
+		if ra := &list.Items[i]; ra.GetName() == name && !keep[ra.GetNamespace()] {
+			if err := client.IgnoreNotFound(r.Delete(ctx, ra)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// routedNamespaces returns the namespaces of the hosts and destinations of the LayerServices for which belongs is
+// true, where requests entering their layers are served.
+func routedNamespaces(ctx context.Context, c client.Client, domain string,
+	belongs func(routelayerv1.LayerService) bool) ([]string, error) {
+	list := &routelayerv1.LayerServiceList{}
+	if err := c.List(ctx, list); err != nil {
+		return nil, err
+	}
+	namespaces := map[string]bool{}
+	for _, ls := range list.Items {
+		if !belongs(ls) {
+			continue
+		}
+		n := routing.Normalize(ls, domain)
+		for _, host := range []string{n.Spec.Host, n.Spec.Destination} {
+			if namespace, ok := routing.HostNamespace(host, domain); ok {
+				namespaces[namespace] = true
+			}
+		}
+	}
+	return sortedKeys(namespaces), nil
+}
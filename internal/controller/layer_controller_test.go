@@ -21,15 +21,27 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+	"github.com/fergalsomers/routelayer/internal/analysis"
 )
 
+// fakeMetrics answers each query with the value given for it, and no value for any other.
+type fakeMetrics map[string]float64
+
+func (m fakeMetrics) Query(_ context.Context, query string) (float64, bool, error) {
+	v, ok := m[query]
+	return v, ok, nil
+}
+
 var _ = Describe("Layer Controller", func() {
 	Context("When reconciling a resource", func() {
 		const resourceName = "test-resource"
@@ -65,6 +77,13 @@ var _ = Describe("Layer Controller", func() {
 
 			By("Cleanup the specific resource instance Layer")
 			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+			// reconcile the deletion, removing the finalizer, so the next spec starts with a new Layer.
+			controllerReconciler := &LayerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			Eventually(func() bool {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				return errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, &routelayerv1.Layer{}))
+			}).Should(BeTrue())
 		})
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
@@ -80,5 +99,193 @@ var _ = Describe("Layer Controller", func() {
 			// TODO(user): Add more specific assertions depending on your controller's reconciliation logic.
 			// Example: If you expect a certain status condition after reconciliation, verify it here.
 		})
+		It("should report a suspended layer", func() {
+			resource := &routelayerv1.Layer{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Suspend = true
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			controllerReconciler := &LayerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.State).To(Equal(SuspendedState))
+		})
+		It("should suspend a degraded layer which asks for it", func() {
+			resource := &routelayerv1.Layer{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Analysis = &routelayerv1.LayerAnalysis{MaxErrorRateIncrease: 5, MaxLatencyIncrease: 50, AutoSuspend: true}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			controllerReconciler := &LayerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme(), Metrics: fakeMetrics{
+				analysis.ErrorRateQuery(resourceName, analysis.DefaultWindow): 20,
+				analysis.ErrorRateQuery("default", analysis.DefaultWindow):    1,
+			}}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Spec.Suspend).To(BeTrue())
+			Expect(resource.Status.State).To(Equal(SuspendedState))
+			Expect(meta.IsStatusConditionTrue(resource.Status.Conditions, DegradedCondition)).To(BeTrue())
+		})
+		It("should not analyze the layer again before its interval has passed", func() {
+			resource := &routelayerv1.Layer{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Analysis = &routelayerv1.LayerAnalysis{MaxErrorRateIncrease: 5, MaxLatencyIncrease: 50}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			metrics := fakeMetrics{
+				analysis.ErrorRateQuery(resourceName, analysis.DefaultWindow): 1,
+				analysis.ErrorRateQuery("default", analysis.DefaultWindow):    1,
+			}
+			controllerReconciler := &LayerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme(), Metrics: metrics}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.LastAnalysisTime).NotTo(BeNil())
+
+			By("the error rate rising before the interval has passed")
+			metrics[analysis.ErrorRateQuery(resourceName, analysis.DefaultWindow)] = 20
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically("<=", defaultAnalysisInterval))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(meta.IsStatusConditionFalse(resource.Status.Conditions, DegradedCondition)).To(BeTrue())
+		})
+		It("should wait for its template", func() {
+			resource := &routelayerv1.Layer{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Template = &routelayerv1.LayerTemplateRef{Name: "missing-template"}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			controllerReconciler := &LayerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.State).To(Equal(WaitingState))
+		})
+		It("should clone its template's Deployments with the images overridden", func() {
+			labels := map[string]string{"app": "echo"}
+			original := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "echo", Namespace: "default"},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: labels},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: labels},
+						Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "echo", Image: "echo:v1"}}},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, original)).To(Succeed())
+			tmpl := &routelayerv1.LayerTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "workload-template"},
+				Spec: routelayerv1.LayerTemplateSpec{Services: []routelayerv1.LayerServiceTemplate{{
+					Name:      "echo-${layer}",
+					Namespace: "default",
+					Spec: routelayerv1.LayerServiceTemplateSpec{
+						Host: "echo", Labels: map[string]string{"version": "${layer}"},
+					},
+					Workload: &routelayerv1.LayerWorkloadTemplate{
+						Deployment: "echo", Images: map[string]string{"echo": "echo:${layer}"},
+					},
+				}}},
+			}
+			Expect(k8sClient.Create(ctx, tmpl)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, tmpl)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, original)).To(Succeed())
+			}()
+			resource := &routelayerv1.Layer{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Template = &routelayerv1.LayerTemplateRef{Name: tmpl.Name}
+			controllerReconciler := &LayerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			_, msg, err := controllerReconciler.stampTemplate(ctx, resource)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg).To(BeEmpty())
+
+			clone := &appsv1.Deployment{}
+			cloneName := types.NamespacedName{Name: "echo-" + resourceName, Namespace: "default"}
+			Expect(k8sClient.Get(ctx, cloneName, clone)).To(Succeed())
+			Expect(clone.Labels).To(HaveKeyWithValue(TemplateLabel, resourceName))
+			Expect(metav1.IsControlledBy(clone, resource)).To(BeTrue())
+			Expect(clone.Spec.Selector.MatchLabels).To(Equal(map[string]string{"app": "echo", "version": resourceName}))
+			Expect(clone.Spec.Template.Labels).To(Equal(clone.Spec.Selector.MatchLabels))
+			Expect(clone.Spec.Template.Spec.Containers[0].Image).To(Equal("echo:" + resourceName))
+
+			By("the template no longer cloning the Deployment")
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: tmpl.Name}, tmpl)).To(Succeed())
+			tmpl.Spec.Services[0].Workload = nil
+			Expect(k8sClient.Update(ctx, tmpl)).To(Succeed())
+			_, _, err = controllerReconciler.stampTemplate(ctx, resource)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, cloneName, clone))).To(BeTrue())
+			Expect(k8sClient.Delete(ctx, &routelayerv1.LayerService{
+				ObjectMeta: metav1.ObjectMeta{Name: "echo-" + resourceName, Namespace: "default"},
+			})).To(Succeed())
+		})
+		It("should wait for LayerServices without ready endpoints", func() {
+			ls := &routelayerv1.LayerService{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-resource-echo", Namespace: "default"},
+				Spec:       routelayerv1.LayerServiceSpec{Layer: resourceName, Host: "echo", Destination: "echo-v2"},
+			}
+			Expect(k8sClient.Create(ctx, ls)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, ls)).To(Succeed())
+			}()
+			ls.Status.State = WaitingState
+			ls.Status.Message = "Waiting for a ready endpoint of echo-v2"
+			Expect(k8sClient.Status().Update(ctx, ls)).To(Succeed())
+
+			controllerReconciler := &LayerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			resource := &routelayerv1.Layer{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.State).To(Equal(WaitingState))
+			Expect(resource.Status.Services).To(Equal(int32(1)))
+			Expect(resource.Status.ReadyServices).To(Equal(int32(0)))
+			Expect(resource.Status.Hosts).To(Equal([]string{"echo.default.svc.cluster.local"}))
+
+			By("the LayerService becoming ready")
+			ls.Status.State = ReadyState
+			Expect(k8sClient.Status().Update(ctx, ls)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.State).To(Equal(ReadyState))
+			Expect(resource.Status.ReadyServices).To(Equal(int32(1)))
+		})
+		It("should reject an enrollment with two hash keys", func() {
+			resource := &routelayerv1.Layer{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Enrollment = &routelayerv1.LayerEnrollment{Percentage: 10, HashHeader: "x-user-id", HashCookie: "session"}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			controllerReconciler := &LayerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.State).To(Equal(ErrorState))
+		})
+		It("should reject an access which allows nothing", func() {
+			resource := &routelayerv1.Layer{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Access = &routelayerv1.LayerAccess{}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			controllerReconciler := &LayerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.State).To(Equal(ErrorState))
+		})
 	})
 })
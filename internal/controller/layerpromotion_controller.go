@@ -0,0 +1,323 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+	"github.com/fergalsomers/routelayer/internal/routing"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// PromotingState is the state of a LayerPromotion being carried out, its status has the plan.
+	PromotingState = "Promoting"
+	// PromotedState is the final state of a LayerPromotion, it is not reconciled again.
+	PromotedState = "Promoted"
+)
+
+// LayerPromotionReconciler reconciles a LayerPromotion object.
+// It moves the LayerServices of a layer into the layer's parent, so the LayerServiceReconciler routes them there.
+type LayerPromotionReconciler struct {
+	client.Client
+	Scheme        *runtime.Scheme
+	ClusterDomain string // DNS domain of the cluster, used to normalize hosts. Defaults to routing.DefaultClusterDomain.
+}
+
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=layerpromotions,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=layerpromotions/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=namespacelayers,verbs=get;list;watch
+
+// Reconcile promotes the layer of the LayerPromotion into its parent, once.
+func (r *LayerPromotionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	log := logger.WithValues("layerpromotion", req.NamespacedName)
+
+	promotion := &routelayerv1.LayerPromotion{}
+	if err := r.Get(ctx, req.NamespacedName, promotion); err != nil {
+		log.Error(err, "unable to fetch LayerPromotion")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !promotion.ObjectMeta.DeletionTimestamp.IsZero() || promotion.Status.State == PromotedState {
+		// a promotion is done once, deleting it does not undo it.
+		return ctrl.Result{}, nil
+	}
+
+	cntrl, err := r.createUpdateLayerPromotion(ctx, promotion, log)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.Status().Update(ctx, promotion); err != nil {
+		return ctrl.Result{}, err
+	}
+	return cntrl, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *LayerPromotionReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&routelayerv1.LayerPromotion{}).
+		Named("layerpromotion").
+		Complete(r)
+}
+
+// createUpdateLayerPromotion moves each LayerService of the layer into its parent. Where the parent already has a
+// LayerService for the host, that one takes the promoted override before the promoted one is deleted, otherwise
+// the promoted one is moved. Either way each host's route table changes in a single step, from routing the layer
+// and its parent differently to routing both to the promoted destination.
+// The layers beneath the promoted one are then moved beneath its parent, and the emptied layer deleted.
+// Nothing is written until the whole promotion is planned and found free of conflicts. The plan is recorded in the
+// status before it is carried out, and each step can be repeated, so a promotion interrupted part way is finished
+// as planned when next reconciled.
+func (r *LayerPromotionReconciler) createUpdateLayerPromotion(ctx context.Context, promotion *routelayerv1.LayerPromotion, log logr.Logger) (ctrl.Result, error) {
+	log.Info("create/update layerpromotion")
+
+	if promotion.Status.State != PromotingState {
+		result, err := r.planPromotion(ctx, promotion)
+		if err != nil || promotion.Status.State != PromotingState {
+			return result, err
+		}
+		// record the plan before carrying it out.
+		if err := r.Status().Update(ctx, promotion); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	layerName, parentName := promotion.Spec.Layer, promotion.Status.Parent
+	for _, p := range promotion.Status.Services {
+		if err := r.promote(ctx, p, layerName, parentName); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	layers := &routelayerv1.LayerList{}
+	if err := r.List(ctx, layers); err != nil {
+		return ctrl.Result{}, err
+	}
+	for i := range layers.Items {
+		if child := &layers.Items[i]; child.Spec.Parent == layerName {
+			child.Spec.Parent = parentName
+			if err := r.Update(ctx, child); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+	layer := &routelayerv1.Layer{ObjectMeta: metav1.ObjectMeta{Name: layerName}}
+	if !promotion.Spec.KeepLayer {
+		if err := r.Delete(ctx, layer); client.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, err
+		}
+	} else if err := r.Get(ctx, client.ObjectKeyFromObject(layer), layer); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	} else if err == nil && layer.Spec.Template != nil {
+		// the kept layer would stamp out the promoted LayerServices again.
+		layer.Spec.Template = nil
+		if err := r.Update(ctx, layer); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	promotion.Status.Message = fmt.Sprintf("%d LayerServices promoted into %s", len(promotion.Status.Services), parentName)
+	promotion.Status.State = PromotedState
+
+	log.Info("layerpromotion", "resourceVersion", promotion.ObjectMeta.ResourceVersion, "state", promotion.Status.State)
+
+	return ctrl.Result{}, nil
+}
+
+// planPromotion finds the LayerServices of the layer and what each is promoted into, and checks the promotion
+// can be carried out. The plan is set in the status, in the PromotingState, otherwise the status says why not.
+func (r *LayerPromotionReconciler) planPromotion(ctx context.Context, promotion *routelayerv1.LayerPromotion) (ctrl.Result, error) {
+	layer := &routelayerv1.Layer{}
+	if err := r.Get(ctx, types.NamespacedName{Name: promotion.Spec.Layer}, layer); err != nil {
+		if !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		promotion.Status.Message = fmt.Sprintf("Layer %s not found", promotion.Spec.Layer)
+		promotion.Status.State = ErrorState
+		return ctrl.Result{}, nil
+	}
+	parentName := layer.Spec.Parent
+	if parentName == "" {
+		promotion.Status.Message = fmt.Sprintf("Layer %s has no parent, the default route is the host itself: "+
+			"deploy the layer's destinations as their hosts instead", layer.Name)
+		promotion.Status.State = ErrorState
+		return ctrl.Result{}, nil
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: parentName}, &routelayerv1.Layer{}); err != nil {
+		promotion.Status.Message = fmt.Sprintf("Parent Layer %s not found", parentName)
+		promotion.Status.State = WaitingState
+		return ctrl.Result{RequeueAfter: defaultWait}, nil
+	}
+
+	shadowed, err := r.shadowedNamespaces(ctx, layer.Name, parentName)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	list := &routelayerv1.LayerServiceList{}
+	if err := r.List(ctx, list); err != nil {
+		return ctrl.Result{}, err
+	}
+	services := slices.DeleteFunc(list.Items, func(ls routelayerv1.LayerService) bool {
+		return shadowed[ls.Namespace] || !ls.DeletionTimestamp.IsZero()
+	})
+	slices.SortFunc(services, func(a, b routelayerv1.LayerService) int {
+		return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+	})
+
+	// the parent's LayerService for each host, the first by name as when the table is built.
+	parents := map[string]string{}
+	for _, ls := range services {
+		if key := r.hostKey(ls); ls.Spec.Layer == parentName && parents[key] == "" {
+			parents[key] = ls.Namespace + "/" + ls.Name
+		}
+	}
+
+	promoted := []routelayerv1.PromotedService{}
+	hosts := map[string]string{}
+	for _, ls := range services {
+		if ls.Spec.Layer != layer.Name {
+			continue
+		}
+		name := ls.Namespace + "/" + ls.Name
+		key := r.hostKey(ls)
+		if other, ok := hosts[key]; ok {
+			// only the first is routed, promoting both would leave the parent routing whichever went last.
+			promotion.Status.Message = fmt.Sprintf("LayerServices %s and %s both override host %s in layer %s, "+
+				"delete one before promoting", other, name, ls.Spec.Host, layer.Name)
+			promotion.Status.State = ErrorState
+			return ctrl.Result{}, nil
+		}
+		hosts[key] = name
+		promoted = append(promoted, routelayerv1.PromotedService{
+			LayerService: name,
+			Host:         ls.Spec.Host,
+			MergedInto:   parents[key],
+		})
+	}
+
+	promotion.Status.Parent = parentName
+	promotion.Status.Services = promoted
+	promotion.Status.Message = fmt.Sprintf("Promoting %d LayerServices into %s", len(promoted), parentName)
+	promotion.Status.State = PromotingState
+	return ctrl.Result{}, nil
+}
+
+// promote carries out a step of the plan. A LayerService already deleted, or no longer in the layer, was promoted.
+// A merge updates the parent's LayerService before deleting the promoted one, so a merge interrupted in between is
+// repeated.
+func (r *LayerPromotionReconciler) promote(ctx context.Context, p routelayerv1.PromotedService, layerName, parentName string) error {
+	ls := &routelayerv1.LayerService{}
+	if err := r.Get(ctx, objectKey(p.LayerService), ls); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if ls.Spec.Layer != layerName {
+		return nil
+	}
+	if p.MergedInto == "" {
+		ls.Spec.Layer = parentName
+		untemplate(ls)
+		return r.Update(ctx, ls)
+	}
+
+	parent := &routelayerv1.LayerService{}
+	if err := r.Get(ctx, objectKey(p.MergedInto), parent); err != nil {
+		return err
+	}
+	// the parent's LayerService takes the whole override, its destinations written out in full as it may be in
+	// another namespace.
+	spec := ls.Spec
+	spec.Layer = parentName
+	spec.Host = parent.Spec.Host
+	if spec.Destination != "" {
+		spec.Destination = routing.Absolute(spec.Destination, ls.Namespace, r.clusterDomain())
+	}
+	if spec.EgressGateway != "" {
+		spec.EgressGateway = routing.Absolute(spec.EgressGateway, ls.Namespace, r.clusterDomain())
+	}
+	parent.Spec = spec
+	untemplate(parent)
+	if err := r.Update(ctx, parent); err != nil {
+		return err
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, ls))
+}
+
+// shadowedNamespaces returns the namespaces where a NamespaceLayer replaces the layer or its parent,
+// their LayerServices are not routed by the cluster Layers so are left alone.
+func (r *LayerPromotionReconciler) shadowedNamespaces(ctx context.Context, layers ...string) (map[string]bool, error) {
+	list := &routelayerv1.NamespaceLayerList{}
+	if err := r.List(ctx, list); err != nil {
+		return nil, err
+	}
+	shadowed := map[string]bool{}
+	for _, nl := range list.Items {
+		if slices.Contains(layers, nl.Name) {
+			shadowed[nl.Namespace] = true
+		}
+	}
+	return shadowed, nil
+}
+
+// untemplate makes a promoted LayerService no longer one stamped out from its layer's template, which would put it
+// back as the template has it, or delete it with the layer.
+func untemplate(ls *routelayerv1.LayerService) {
+	layer, ok := ls.Labels[TemplateLabel]
+	if !ok {
+		return
+	}
+	delete(ls.Labels, TemplateLabel)
+	ls.OwnerReferences = slices.DeleteFunc(ls.OwnerReferences, func(ref metav1.OwnerReference) bool {
+		return ref.Kind == "Layer" && ref.Name == layer
+	})
+}
+
+// objectKey parses the namespace/name a PromotedService refers to LayerServices by.
+func objectKey(name string) types.NamespacedName {
+	namespace, name, _ := strings.Cut(name, "/")
+	return types.NamespacedName{Namespace: namespace, Name: name}
+}
+
+// hostKey identifies the host a LayerService overrides, as the LayerServiceReconciler does.
+func (r *LayerPromotionReconciler) hostKey(ls routelayerv1.LayerService) string {
+	host := routing.FQDN(ls.Spec.Host, ls.Namespace, r.clusterDomain())
+	namespace := ls.Namespace
+	if hostNamespace, ok := routing.HostNamespace(host, r.clusterDomain()); ok {
+		namespace = hostNamespace
+	}
+	return namespace + "/" + host
+}
+
+func (r *LayerPromotionReconciler) clusterDomain() string {
+	if r.ClusterDomain == "" {
+		return routing.DefaultClusterDomain
+	}
+	return r.ClusterDomain
+}
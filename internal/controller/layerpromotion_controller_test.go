@@ -0,0 +1,205 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+var _ = Describe("LayerPromotion Reconciler", func() {
+	Context("When reconciling a LayerPromotion", func() {
+		const resourceName = "test-layerpromotion"
+
+		ctx := context.Background()
+
+		namespacedName := types.NamespacedName{Name: resourceName}
+
+		layerService := func(name, layer, destination string) *routelayerv1.LayerService {
+			return &routelayerv1.LayerService{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				Spec:       routelayerv1.LayerServiceSpec{Layer: layer, Host: "promote-echo", Destination: destination},
+			}
+		}
+
+		reconcile := func() *routelayerv1.LayerPromotion {
+			rc := &LayerPromotionReconciler{Client: k8sClient}
+			_, err := rc.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			p := &routelayerv1.LayerPromotion{}
+			Expect(k8sClient.Get(ctx, namespacedName, p)).To(Succeed())
+			return p
+		}
+
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, &routelayerv1.Layer{ObjectMeta: metav1.ObjectMeta{Name: "promote-v2"}})).To(Succeed())
+			Expect(k8sClient.Create(ctx, &routelayerv1.Layer{
+				ObjectMeta: metav1.ObjectMeta{Name: "promote-v3"},
+				Spec:       routelayerv1.LayerSpec{Parent: "promote-v2"},
+			})).To(Succeed())
+			Expect(k8sClient.Create(ctx, layerService("promote-echo-v2", "promote-v2", "echo-v2"))).To(Succeed())
+			promoted := layerService("promote-echo-v3", "promote-v3", "echo-v3")
+			promoted.Spec.Adopt = true
+			Expect(k8sClient.Create(ctx, promoted)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			for _, obj := range []client.Object{
+				&routelayerv1.LayerPromotion{ObjectMeta: metav1.ObjectMeta{Name: resourceName}},
+				&routelayerv1.Layer{ObjectMeta: metav1.ObjectMeta{Name: "promote-v2"}},
+				&routelayerv1.Layer{ObjectMeta: metav1.ObjectMeta{Name: "promote-v3"}},
+				layerService("promote-echo-v2", "", ""),
+				layerService("promote-echo-v3", "", ""),
+			} {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, obj))).To(Succeed())
+			}
+		})
+
+		It("LayerPromotion should merge the layer's LayerServices into its parent and delete it", func() {
+			Expect(k8sClient.Create(ctx, &routelayerv1.LayerPromotion{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName},
+				Spec:       routelayerv1.LayerPromotionSpec{Layer: "promote-v3"},
+			})).To(Succeed())
+
+			p := reconcile()
+			Expect(p.Status.State).To(Equal(PromotedState))
+			Expect(p.Status.Services).To(Equal([]routelayerv1.PromotedService{{
+				LayerService: "default/promote-echo-v3",
+				Host:         "promote-echo",
+				MergedInto:   "default/promote-echo-v2",
+			}}))
+
+			parent := &routelayerv1.LayerService{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "promote-echo-v2", Namespace: "default"}, parent)).To(Succeed())
+			Expect(parent.Spec.Layer).To(Equal("promote-v2"))
+			Expect(parent.Spec.Destination).To(Equal("echo-v3.default.svc.cluster.local"))
+			Expect(parent.Spec.Adopt).To(BeTrue())
+
+			err := k8sClient.Get(ctx, types.NamespacedName{Name: "promote-v3"}, &routelayerv1.Layer{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("LayerPromotion should finish the promotion recorded in its status", func() {
+			promotion := &routelayerv1.LayerPromotion{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName},
+				Spec:       routelayerv1.LayerPromotionSpec{Layer: "promote-v3", KeepLayer: true},
+			}
+			Expect(k8sClient.Create(ctx, promotion)).To(Succeed())
+			By("interrupting the promotion once its plan is recorded")
+			promotion.Status = routelayerv1.LayerPromotionStatus{
+				State:  PromotingState,
+				Parent: "promote-v2",
+				Services: []routelayerv1.PromotedService{{
+					LayerService: "default/promote-echo-v3",
+					Host:         "promote-echo",
+					MergedInto:   "default/promote-echo-v2",
+				}},
+			}
+			Expect(k8sClient.Status().Update(ctx, promotion)).To(Succeed())
+
+			p := reconcile()
+			Expect(p.Status.State).To(Equal(PromotedState))
+			parent := &routelayerv1.LayerService{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "promote-echo-v2", Namespace: "default"}, parent)).To(Succeed())
+			Expect(parent.Spec.Destination).To(Equal("echo-v3.default.svc.cluster.local"))
+			err := k8sClient.Get(ctx, types.NamespacedName{Name: "promote-echo-v3", Namespace: "default"}, &routelayerv1.LayerService{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("LayerPromotion of a layer overriding a host twice should be in error, and change nothing", func() {
+			Expect(k8sClient.Create(ctx, layerService("promote-echo-v3b", "promote-v3", "echo-v3b"))).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, layerService("promote-echo-v3b", "", ""))).To(Succeed())
+			}()
+			Expect(k8sClient.Create(ctx, &routelayerv1.LayerPromotion{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName},
+				Spec:       routelayerv1.LayerPromotionSpec{Layer: "promote-v3"},
+			})).To(Succeed())
+
+			p := reconcile()
+			Expect(p.Status.State).To(Equal(ErrorState))
+			Expect(p.Status.Message).To(ContainSubstring("both override host"))
+			parent := &routelayerv1.LayerService{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "promote-echo-v2", Namespace: "default"}, parent)).To(Succeed())
+			Expect(parent.Spec.Destination).To(Equal("echo-v2"))
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "promote-v3"}, &routelayerv1.Layer{})).To(Succeed())
+		})
+
+		It("LayerPromotion of a templated layer should keep the LayerServices it moves", func() {
+			tmpl := &routelayerv1.LayerTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "promote-template"},
+				Spec: routelayerv1.LayerTemplateSpec{Services: []routelayerv1.LayerServiceTemplate{{
+					Name:      "promote-db-${layer}",
+					Namespace: "default",
+					Spec:      routelayerv1.LayerServiceTemplateSpec{Host: "promote-db", Destination: "db-${layer}"},
+				}}},
+			}
+			Expect(k8sClient.Create(ctx, tmpl)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, tmpl)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, layerService("promote-db-promote-v3", "", ""))).To(Succeed())
+			}()
+			layer := &routelayerv1.Layer{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "promote-v3"}, layer)).To(Succeed())
+			layer.Spec.Template = &routelayerv1.LayerTemplateRef{Name: tmpl.Name}
+			Expect(k8sClient.Update(ctx, layer)).To(Succeed())
+			lc := &LayerReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			_, _, err := lc.stampTemplate(ctx, layer)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Create(ctx, &routelayerv1.LayerPromotion{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName},
+				Spec:       routelayerv1.LayerPromotionSpec{Layer: "promote-v3", KeepLayer: true},
+			})).To(Succeed())
+			Expect(reconcile().Status.State).To(Equal(PromotedState))
+
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "promote-v3"}, layer)).To(Succeed())
+			Expect(layer.Spec.Template).To(BeNil())
+			By("stamping out the template again")
+			layer.Spec.Template = &routelayerv1.LayerTemplateRef{Name: tmpl.Name}
+			_, _, err = lc.stampTemplate(ctx, layer)
+			Expect(err).NotTo(HaveOccurred())
+
+			moved := &routelayerv1.LayerService{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "promote-db-promote-v3", Namespace: "default"}, moved)).To(Succeed())
+			Expect(moved.Spec.Layer).To(Equal("promote-v2"))
+			Expect(moved.Labels).NotTo(HaveKey(TemplateLabel))
+			Expect(moved.OwnerReferences).To(BeEmpty())
+		})
+
+		It("LayerPromotion of a layer without a parent should be in error", func() {
+			Expect(k8sClient.Create(ctx, &routelayerv1.LayerPromotion{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName},
+				Spec:       routelayerv1.LayerPromotionSpec{Layer: "promote-v2"},
+			})).To(Succeed())
+
+			p := reconcile()
+			Expect(p.Status.State).To(Equal(ErrorState))
+		})
+	})
+})
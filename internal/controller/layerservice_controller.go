@@ -0,0 +1,910 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	controllerutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+	"github.com/fergalsomers/routelayer/internal/remote"
+	"github.com/fergalsomers/routelayer/internal/routing"
+	"github.com/go-logr/logr"
+)
+
+// LayerServiceReconciler reconciles a LayerService object.
+// All the LayerServices for a host are rendered together into a single VirtualService (and DestinationRule).
+type LayerServiceReconciler struct {
+	client.Client
+	Scheme        *runtime.Scheme
+	IstioEnabled  bool   // Whether integration with istio should be enabled or not. Defaults to false.
+	LayerHeader   string // Header used to select a layer. Defaults to routing.DefaultLayerHeader.
+	ClusterDomain string // DNS domain of the cluster, used to normalize hosts. Defaults to routing.DefaultClusterDomain.
+	// Snapshots of a host's route table to keep. Defaults to routing.DefaultSnapshotRevisions.
+	SnapshotRevisions int
+	// AccessLogProvider writes the access logs of the workloads taking part in layers, when set.
+	AccessLogProvider string
+	// Remotes are the other clusters of the mesh the routes are programmed in, none when nil.
+	Remotes *remote.Clusters
+	// EgressGateway is the service of the istio egress gateway requests to hosts outside the cluster leave the mesh
+	// through, in routing.DefaultRootNamespace unless it has a namespace. They leave directly when empty.
+	EgressGateway string
+}
+
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=layerservices,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=layerservices/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=layerservices/finalizers,verbs=update
+// +kubebuilder:rbac:groups=networking.istio.io,resources=virtualservices;destinationrules;serviceentries;gateways,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=telemetry.istio.io,resources=telemetries,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=routerollbacks,verbs=get;list;watch
+
+// Reconcile validates the LayerService and regenerates the routes for its host.
+func (r *LayerServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	log := logger.WithValues("layerservice", req.NamespacedName)
+
+	ls := &routelayerv1.LayerService{}
+	if err := r.Get(ctx, req.NamespacedName, ls); err != nil {
+		log.Error(err, "unable to fetch LayerService")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if ls.ObjectMeta.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(ls, RouteLayerFinalizer) {
+			controllerutil.AddFinalizer(ls, RouteLayerFinalizer)
+			if err := r.Update(ctx, ls); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	} else {
+		if controllerutil.ContainsFinalizer(ls, RouteLayerFinalizer) {
+			// regenerate the host without this LayerService before letting it go.
+			if _, err := r.reconcileHost(ctx, ls, log); err != nil {
+				return ctrl.Result{}, err
+			}
+
+			controllerutil.RemoveFinalizer(ls, RouteLayerFinalizer)
+			if err := r.Update(ctx, ls); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+
+	cntrl, err := r.createUpdateLayerService(ctx, ls, log)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.Status().Update(ctx, ls); err != nil {
+		return ctrl.Result{}, err
+	}
+	return cntrl, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// A change to any Layer can change the routes of every host (layers inherit from their parents),
+// so Layer events requeue all the LayerServices. As do NamespaceLayer and LayerPolicy events, which
+// change the layers a namespace may route, and RouteRollback events, which pause and resume routing.
+// EndpointSlice events requeue the LayerServices they serve, which are only routed once they have a ready endpoint.
+// With remote clusters, changes to their kubeconfig Secrets requeue all the LayerServices.
+// With istio enabled, changes to VirtualServices and DestinationRules requeue the LayerServices of their host,
+// so drift is put back and conflicts are noticed.
+func (r *LayerServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&routelayerv1.LayerService{}).
+		Watches(&routelayerv1.Layer{}, handler.EnqueueRequestsFromMapFunc(r.allLayerServices)).
+		Watches(&routelayerv1.NamespaceLayer{}, handler.EnqueueRequestsFromMapFunc(r.allLayerServices)).
+		Watches(&routelayerv1.LayerPolicy{}, handler.EnqueueRequestsFromMapFunc(r.allLayerServices)).
+		Watches(&routelayerv1.RouteRollback{}, handler.EnqueueRequestsFromMapFunc(r.allLayerServices)).
+		Watches(&discoveryv1.EndpointSlice{}, handler.EnqueueRequestsFromMapFunc(r.endpointLayerServices))
+	if r.Remotes != nil {
+		b = b.Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.allLayerServices),
+			builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+				return obj.GetNamespace() == r.Remotes.Namespace && obj.GetLabels()[remote.SecretLabel] == "true"
+			})))
+	}
+	if r.IstioEnabled {
+		b = b.Watches(routing.NewVirtualService("", ""), handler.EnqueueRequestsFromMapFunc(r.hostLayerServices)).
+			Watches(routing.NewDestinationRule("", ""), handler.EnqueueRequestsFromMapFunc(r.hostLayerServices))
+	}
+	return b.Named("layerservice").Complete(r)
+}
+
+// hostLayerServices maps an istio resource to the LayerServices of the host it routes: the host recorded on the
+// resources routelayer writes, or any of the hosts of a VirtualService it did not.
+func (r *LayerServiceReconciler) hostLayerServices(ctx context.Context, obj client.Object) []reconcile.Request {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil
+	}
+	list := &routelayerv1.LayerServiceList{}
+	if err := r.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list LayerServices")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, ls := range list.Items {
+		host, _ := r.host(&ls)
+		if u.GetAnnotations()[routing.HostAnnotation] == host || routing.RoutesHost(u, host, r.clusterDomain()) {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: ls.Name, Namespace: ls.Namespace},
+			})
+		}
+	}
+	return requests
+}
+
+// endpointLayerServices maps an EndpointSlice to the LayerServices served by its service: those with it as their
+// destination, or as their host when they have none.
+func (r *LayerServiceReconciler) endpointLayerServices(ctx context.Context, obj client.Object) []reconcile.Request {
+	name := obj.GetLabels()[discoveryv1.LabelServiceName]
+	if name == "" {
+		return nil
+	}
+	service := routing.FQDN(name, obj.GetNamespace(), r.clusterDomain())
+	list := &routelayerv1.LayerServiceList{}
+	if err := r.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list LayerServices")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, ls := range list.Items {
+		n := routing.Normalize(ls, r.clusterDomain())
+		if n.Spec.Destination == service || (n.Spec.Destination == "" && n.Spec.Host == service) {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: ls.Name, Namespace: ls.Namespace},
+			})
+		}
+	}
+	return requests
+}
+
+func (r *LayerServiceReconciler) allLayerServices(ctx context.Context, _ client.Object) []reconcile.Request {
+	list := &routelayerv1.LayerServiceList{}
+	if err := r.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list LayerServices")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, ls := range list.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: ls.Name, Namespace: ls.Namespace},
+		})
+	}
+	return requests
+}
+
+func (r *LayerServiceReconciler) createUpdateLayerService(ctx context.Context, ls *routelayerv1.LayerService, log logr.Logger) (ctrl.Result, error) {
+	log.Info("create/update layerservice")
+
+	if msg := validateLayerService(routing.Normalize(*ls, r.clusterDomain()), r.clusterDomain(), r.egressGateway()); msg != "" {
+		ls.Status.Message = msg
+		ls.Status.State = ErrorState
+		// it may have been routed before it changed, the host is routed without it.
+		_, err := r.reconcileHost(ctx, ls, log)
+		return ctrl.Result{}, err
+	}
+
+	host, hostNamespace := r.host(ls)
+	permitted, err := overridePermitted(ctx, r.Client, ls.Namespace, hostNamespace)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !permitted {
+		ls.Status.Message = fmt.Sprintf("No LayerPolicy permits namespace %s to override host %s", ls.Namespace, host)
+		ls.Status.State = ErrorState
+		_, err := r.reconcileHost(ctx, ls, log)
+		return ctrl.Result{}, err
+	}
+
+	// the host is routed with the layers of its own namespace, see reconcileHost.
+	layers, err := r.routableLayers(ctx, hostNamespace)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	i := slices.IndexFunc(layers, func(l routelayerv1.Layer) bool { return l.Name == ls.Spec.Layer })
+	if i < 0 {
+		ls.Status.Message = fmt.Sprintf("Layer %s not found", ls.Spec.Layer)
+		if hostNamespace != ls.Namespace {
+			ls.Status.Message = fmt.Sprintf("Layer %s is not routable in namespace %s of host %s",
+				ls.Spec.Layer, hostNamespace, host)
+		}
+		ls.Status.State = WaitingState
+		if _, err := r.reconcileHost(ctx, ls, log); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		return ctrl.Result{
+			RequeueAfter: defaultWait,
+		}, nil
+	}
+
+	clusters, err := r.clusters(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	ready, err := endpointsReady(ctx, clusters, routing.Normalize(*ls, r.clusterDomain()), r.clusterDomain())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	destination := ls.Spec.Destination
+	if destination == "" {
+		destination = host
+	}
+	if ready {
+		meta.SetStatusCondition(&ls.Status.Conditions, metav1.Condition{
+			Type:   EndpointsReadyCondition,
+			Status: metav1.ConditionTrue,
+			Reason: "EndpointReady",
+		})
+	} else {
+		meta.SetStatusCondition(&ls.Status.Conditions, metav1.Condition{
+			Type:    EndpointsReadyCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  "NoReadyEndpoints",
+			Message: fmt.Sprintf("No ready endpoint of %s%s, the layer falls back to its parent", destination, subset(ls.Spec.Labels)),
+		})
+	}
+
+	status, err := r.reconcileHost(ctx, ls, log)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(status.drifted) > 0 {
+		meta.SetStatusCondition(&ls.Status.Conditions, metav1.Condition{
+			Type:               DriftedCondition,
+			Status:             metav1.ConditionTrue,
+			Reason:             "Reapplied",
+			Message:            strings.Join(status.drifted, "; "),
+			ObservedGeneration: ls.Generation,
+		})
+	} else if c := meta.FindStatusCondition(ls.Status.Conditions, DriftedCondition); c == nil || c.ObservedGeneration != ls.Generation {
+		// a drift is reported until the LayerService next changes.
+		meta.SetStatusCondition(&ls.Status.Conditions, metav1.Condition{
+			Type:               DriftedCondition,
+			Status:             metav1.ConditionFalse,
+			Reason:             "NoDrift",
+			ObservedGeneration: ls.Generation,
+		})
+	}
+	if status.conflict != "" {
+		meta.SetStatusCondition(&ls.Status.Conditions, metav1.Condition{
+			Type:   ConflictCondition,
+			Status: metav1.ConditionTrue,
+			Reason: "VirtualServiceExists",
+			Message: fmt.Sprintf("VirtualService %s already routes host %s, set adopt to merge the layer routes into it",
+				status.conflict, host),
+		})
+		ls.Status.Message = fmt.Sprintf("Host %s is routed by VirtualService %s", host, status.conflict)
+		ls.Status.State = ErrorState
+		return ctrl.Result{}, nil
+	}
+	meta.SetStatusCondition(&ls.Status.Conditions, metav1.Condition{
+		Type:   ConflictCondition,
+		Status: metav1.ConditionFalse,
+		Reason: "NoConflict",
+	})
+	result := ctrl.Result{}
+	if r.Remotes != nil && r.IstioEnabled {
+		condition := metav1.Condition{
+			Type:   RemoteClustersCondition,
+			Status: metav1.ConditionTrue,
+			Reason: "Synced",
+		}
+		if len(status.remoteFailures) > 0 {
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "SyncFailed"
+			condition.Message = strings.Join(status.remoteFailures, "; ")
+		}
+		meta.SetStatusCondition(&ls.Status.Conditions, condition)
+		// the remote clusters aren't watched, look at them again.
+		result.RequeueAfter = defaultWait
+	}
+
+	ls.Status.Revision = status.revision
+	ls.Status.Snapshot = status.snapshot
+	ls.Status.Routes = status.routes
+
+	if status.missingSnapshot != "" {
+		ls.Status.Message = fmt.Sprintf("Host %s is rolled back to snapshot %s, which no longer exists, "+
+			"it is routed from its LayerServices", host, status.missingSnapshot)
+		ls.Status.State = ErrorState
+		return result, nil
+	}
+
+	if status.rollback != "" {
+		ls.Status.Message = fmt.Sprintf("Host %s is rolled back to revision %d by RouteRollback %s",
+			host, status.revision, status.rollback)
+		ls.Status.State = PausedState
+		return result, nil
+	}
+
+	if layers[i].Spec.Suspend {
+		ls.Status.Message = fmt.Sprintf("Layer %s is suspended", ls.Spec.Layer)
+		ls.Status.State = SuspendedState
+		return result, nil
+	}
+
+	if !ready {
+		ls.Status.Message = fmt.Sprintf("Waiting for a ready endpoint of %s%s", destination, subset(ls.Spec.Labels))
+		ls.Status.State = WaitingState
+		return result, nil
+	}
+
+	ls.Status.Message = "LayerService routed"
+	ls.Status.State = ReadyState
+
+	log.Info("layerservice", "resourceVersion", ls.ObjectMeta.ResourceVersion, "state", ls.Status.State)
+
+	return result, nil
+}
+
+// subset describes the pods a LayerService's labels select, for messages.
+func subset(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	selector := []string{}
+	for _, k := range sortedKeys(labels) {
+		selector = append(selector, k+"="+labels[k])
+	}
+	return " with labels " + strings.Join(selector, ",")
+}
+
+// validateLayerService checks a normalized LayerService. egress is the default egress gateway, if any.
+func validateLayerService(ls routelayerv1.LayerService, domain, egress string) string {
+	if ls.Spec.Destination == "" && len(ls.Spec.Labels) == 0 {
+		return "Either destination or labels must be specified"
+	}
+	if ls.Spec.Destination == ls.Spec.Host {
+		return "Destination must be different from the host"
+	}
+	if ls.Spec.Protocol == routelayerv1.ProtocolTCP && len(ls.Spec.Ports) == 0 {
+		return "Ports must be specified for tcp, they are how connections enter the layer"
+	}
+	destination := ls.Spec.Destination
+	if destination == "" {
+		destination = ls.Spec.Host
+	}
+	_, cluster := routing.HostNamespace(destination, domain)
+	if len(ls.Spec.Labels) > 0 && !cluster {
+		return fmt.Sprintf("Labels select pods, %s is outside the cluster", destination)
+	}
+	if ls.Spec.DestinationTLS {
+		if ls.Spec.Destination == "" || cluster {
+			return "DestinationTLS needs a destination outside the cluster"
+		}
+		if ls.Spec.Protocol == routelayerv1.ProtocolTCP || ls.Spec.Protocol == routelayerv1.ProtocolTLS {
+			return "DestinationTLS needs requests the sidecar can read, not " + ls.Spec.Protocol
+		}
+	}
+	_, internalHost := routing.HostNamespace(ls.Spec.Host, domain)
+	if ls.Spec.EgressGateway != "" {
+		if _, ok := routing.HostNamespace(ls.Spec.EgressGateway, domain); !ok {
+			return fmt.Sprintf("EgressGateway %s is not a service of the cluster", ls.Spec.EgressGateway)
+		}
+		if internalHost || cluster {
+			return "EgressGateway needs a host and a destination outside the cluster"
+		}
+		egress = ls.Spec.EgressGateway
+	}
+	opaque := ls.Spec.Protocol == routelayerv1.ProtocolTCP || ls.Spec.Protocol == routelayerv1.ProtocolTLS
+	if egress != "" && !internalHost && !opaque &&
+		slices.ContainsFunc(ls.Spec.Ports, func(p uint32) bool { return p != routing.EgressPort }) {
+		return fmt.Sprintf("Requests leave through egress gateway %s on port %d, no other ports can be routed",
+			egress, routing.EgressPort)
+	}
+	return ""
+}
+
+// host returns the FQDN of the LayerService's host and the namespace its istio resources are generated in:
+// the namespace of the service for cluster hosts, otherwise the LayerService's own namespace.
+func (r *LayerServiceReconciler) host(ls *routelayerv1.LayerService) (string, string) {
+	host := routing.FQDN(ls.Spec.Host, ls.Namespace, r.clusterDomain())
+	if namespace, ok := routing.HostNamespace(host, r.clusterDomain()); ok {
+		return host, namespace
+	}
+	return host, ls.Namespace
+}
+
+// hostStatus is what reconciling a host found.
+type hostStatus struct {
+	conflict string   // the VirtualService, not generated by routelayer, which routes the host
+	drifted  []string // the generated resources someone else changed, which were put back
+	revision int64    // of the route table routed
+	snapshot string   // the ConfigMap the revision is kept in
+	routes   []routelayerv1.LayerRoute
+	rollback string // the RouteRollback the host is routed by, instead of its LayerServices
+	// missingSnapshot - the snapshot the host is rolled back to, which no longer exists, and its RouteRollback
+	missingSnapshot string
+	// remoteFailures - why the remote clusters which couldn't be programmed couldn't be
+	remoteFailures []string
+}
+
+// reconcileHost regenerates the istio resources for the LayerService's host, and records it in the status. When the
+// host was changed the one routed before, as the status has it, is regenerated too so it no longer routes the
+// LayerService.
+func (r *LayerServiceReconciler) reconcileHost(ctx context.Context, ls *routelayerv1.LayerService, log logr.Logger) (hostStatus, error) {
+	host, namespace := r.host(ls)
+	if !r.IstioEnabled {
+		ls.Status.Host = host
+		return hostStatus{}, nil
+	}
+
+	if previous := ls.Status.Host; previous != "" && previous != host {
+		previousNamespace, ok := routing.HostNamespace(previous, r.clusterDomain())
+		if !ok {
+			previousNamespace = ls.Namespace
+		}
+		if _, err := r.routeHost(ctx, previous, previousNamespace, log); err != nil {
+			return hostStatus{}, err
+		}
+	}
+	if err := r.reconcileTelemetry(ctx, ls.Namespace, namespace); err != nil {
+		return hostStatus{}, err
+	}
+	status, err := r.routeHost(ctx, host, namespace, log)
+	if err != nil {
+		return status, err
+	}
+	ls.Status.Host = host
+	return status, nil
+}
+
+// routeHost regenerates the istio resources for host, generated in namespace, from all of the host's LayerServices.
+// LayerServices in other namespaces contribute when a LayerPolicy permits them to override the host;
+// the layers are those routable in the host's namespace.
+// If a VirtualService not generated by routelayer routes the host, the layer routes are merged into it when
+// the host is adopted. Otherwise it is left alone and reported as the conflict.
+func (r *LayerServiceReconciler) routeHost(ctx context.Context, host, namespace string, log logr.Logger) (hostStatus, error) {
+	status := hostStatus{}
+	services, err := r.hostServices(ctx, host, namespace)
+	if err != nil {
+		return status, err
+	}
+	layers, err := r.routableLayers(ctx, namespace)
+	if err != nil {
+		return status, err
+	}
+
+	table := routing.BuildTable(host, namespace, services, layers)
+	rollback, rolledBack, err := r.rollback(ctx, host)
+	if err != nil {
+		return status, err
+	}
+	if rollback != nil {
+		// the LayerServices are paused, the host is routed as it was in the snapshot.
+		cm := &corev1.ConfigMap{}
+		err := r.Get(ctx, types.NamespacedName{Name: rolledBack.Snapshot, Namespace: rolledBack.Namespace}, cm)
+		switch {
+		case rolledBack.Missing || errors.IsNotFound(err):
+			// the snapshot was deleted, the host is routed from its LayerServices rather than not at all.
+			status.missingSnapshot = fmt.Sprintf("%s of RouteRollback %s", rolledBack.Snapshot, rollback.Name)
+			rollback = nil
+		case err != nil:
+			return status, err
+		default:
+			if table, _, err = routing.ReadSnapshot(cm); err != nil {
+				return status, err
+			}
+			status.rollback = rollback.Name
+		}
+	}
+	table = routing.RouteEgress(routing.MarkExternal(table, r.clusterDomain()), r.egressGateway())
+	log.Info("routing host", "host", host, "routes", len(table.Routes), "rollback", status.rollback)
+
+	existing, err := r.unownedVirtualService(ctx, host, namespace)
+	if err != nil {
+		return status, err
+	}
+	name := routing.Name(host)
+	if existing != nil {
+		if !table.Adopt {
+			if routing.Adopted(existing) {
+				// no longer adopted, restore the routes it was written with.
+				if err := r.apply(ctx, routing.Adopt(existing, routing.Table{Host: host}, r.layerHeader())); err != nil {
+					return status, err
+				}
+			}
+			if len(table.Routes) > 0 {
+				status.conflict = existing.GetName()
+				return status, nil
+			}
+		} else {
+			if err := r.apply(ctx, routing.Adopt(existing, table, r.layerHeader())); err != nil {
+				return status, err
+			}
+			log.Info("adopted VirtualService", "name", existing.GetName())
+		}
+	}
+
+	if rollback != nil {
+		status.revision = rolledBack.Revision
+		status.snapshot = rolledBack.Snapshot
+		status.routes = routing.LayerRoutes(table)
+	} else {
+		snapshot, err := r.snapshot(ctx, table)
+		if err != nil {
+			return status, err
+		}
+		if snapshot != nil {
+			status.revision, _ = routing.Revision(snapshot)
+			status.snapshot = snapshot.Name
+			status.routes = routing.LayerRoutes(table)
+		}
+	}
+
+	selectors, err := r.egressSelectors(ctx, table)
+	if err != nil {
+		return status, err
+	}
+	if r.Remotes != nil {
+		if status.remoteFailures, err = r.reconcileRemotes(ctx, table, selectors); err != nil {
+			return status, err
+		}
+	} else if err := r.syncCluster(ctx, r.Client, table, r.externalResources(table, selectors), false); err != nil {
+		return status, err
+	}
+
+	if len(table.Routes) == 0 {
+		if err := r.deleteIfExists(ctx, routing.NewVirtualService(name, namespace)); err != nil {
+			return status, err
+		}
+		return status, r.deleteIfExists(ctx, routing.NewDestinationRule(name, namespace))
+	}
+
+	desired := []*unstructured.Unstructured{}
+	if existing != nil {
+		// the adopted VirtualService routes the host instead.
+		if err := r.deleteIfExists(ctx, routing.NewVirtualService(name, namespace)); err != nil {
+			return status, err
+		}
+	} else {
+		desired = append(desired, routing.VirtualService(table, r.layerHeader()))
+	}
+	if dr := routing.DestinationRule(table); dr != nil {
+		desired = append(desired, dr)
+	} else if err := r.deleteIfExists(ctx, routing.NewDestinationRule(name, namespace)); err != nil {
+		return status, err
+	}
+	for _, obj := range desired {
+		drift, err := r.applyGenerated(ctx, obj)
+		if err != nil {
+			return status, err
+		}
+		if drift != "" {
+			log.Info("re-applied drifted resource", "drift", drift)
+			status.drifted = append(status.drifted, drift)
+		}
+	}
+	return status, nil
+}
+
+// egressSelectors returns the pod labels of each egress gateway the table's requests leave the mesh through,
+// those its service selects.
+func (r *LayerServiceReconciler) egressSelectors(ctx context.Context, t routing.Table) (map[string]map[string]string, error) {
+	selectors := map[string]map[string]string{}
+	for _, gateway := range routing.EgressGateways(t) {
+		namespace, _ := routing.HostNamespace(gateway, r.clusterDomain())
+		name, _, _ := strings.Cut(gateway, ".")
+		svc := &corev1.Service{}
+		if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, svc); err != nil {
+			return nil, fmt.Errorf("egress gateway %s: %w", gateway, err)
+		}
+		selectors[gateway] = svc.Spec.Selector
+	}
+	return selectors, nil
+}
+
+// externalResources renders the resources routing the table's host and destinations outside the cluster,
+// afresh for each cluster they are applied in.
+func (r *LayerServiceReconciler) externalResources(t routing.Table, selectors map[string]map[string]string) []*unstructured.Unstructured {
+	return append(routing.ExternalResources(t), routing.EgressResources(t, r.layerHeader(), selectors)...)
+}
+
+// rollback returns the RouteRollback the host is rolled back by, nil if it is not.
+// If several roll the host back, the most recently created wins. A RouteRollback in error still has the hosts whose
+// snapshot is missing, so they are reported.
+func (r *LayerServiceReconciler) rollback(ctx context.Context, host string) (*routelayerv1.RouteRollback, *routelayerv1.RolledBackHost, error) {
+	list := &routelayerv1.RouteRollbackList{}
+	if err := r.List(ctx, list); err != nil {
+		return nil, nil, err
+	}
+	var found *routelayerv1.RouteRollback
+	var rolledBack *routelayerv1.RolledBackHost
+	for i := range list.Items {
+		rollback := &list.Items[i]
+		if !rollback.DeletionTimestamp.IsZero() {
+			continue
+		}
+		j := slices.IndexFunc(rollback.Status.Hosts, func(h routelayerv1.RolledBackHost) bool { return h.Host == host })
+		if j < 0 {
+			continue
+		}
+		if found == nil || found.CreationTimestamp.Before(&rollback.CreationTimestamp) {
+			found, rolledBack = rollback, &rollback.Status.Hosts[j]
+		}
+	}
+	return found, rolledBack, nil
+}
+
+// snapshot keeps the route table in a new revision, if it has changed since the latest, and deletes the
+// revisions beyond those retained, but those a RouteRollback rolls back to.
+// It returns the latest snapshot, nil if the host has never had routes.
+func (r *LayerServiceReconciler) snapshot(ctx context.Context, t routing.Table) (*corev1.ConfigMap, error) {
+	list := &corev1.ConfigMapList{}
+	if err := r.List(ctx, list, client.InNamespace(t.Namespace), client.MatchingLabels(routing.SnapshotLabels(t.Host))); err != nil {
+		return nil, err
+	}
+	snapshots := list.Items
+	routing.SortSnapshots(snapshots)
+
+	var revision int64
+	if len(snapshots) > 0 {
+		latest, rev, err := routing.ReadSnapshot(&snapshots[0])
+		if err == nil && routing.SameRoutes(latest, t) {
+			return &snapshots[0], nil
+		}
+		revision = rev
+	} else if len(t.Routes) == 0 {
+		return nil, nil
+	}
+
+	snapshot, err := routing.NewSnapshot(t, revision+1)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Create(ctx, snapshot); err != nil {
+		return nil, err
+	}
+	snapshots = append([]corev1.ConfigMap{*snapshot}, snapshots...)
+	rollbacks := &routelayerv1.RouteRollbackList{}
+	if err := r.List(ctx, rollbacks); err != nil {
+		return nil, err
+	}
+	rolledBack := map[string]bool{}
+	for _, rollback := range rollbacks.Items {
+		for _, h := range rollback.Status.Hosts {
+			rolledBack[h.Namespace+"/"+h.Snapshot] = true
+		}
+	}
+	for i := r.snapshotRevisions(); i < len(snapshots); i++ {
+		if rolledBack[snapshots[i].Namespace+"/"+snapshots[i].Name] {
+			continue
+		}
+		if err := client.IgnoreNotFound(r.Delete(ctx, &snapshots[i])); err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+// unownedVirtualService returns the VirtualService in namespace, not generated by routelayer, which routes host.
+// If there are several the first by name is returned, so the same one is always adopted.
+func (r *LayerServiceReconciler) unownedVirtualService(ctx context.Context, host, namespace string) (*unstructured.Unstructured, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(routing.VirtualServiceGVK.GroupVersion().WithKind("VirtualServiceList"))
+	if err := r.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var found *unstructured.Unstructured
+	for i := range list.Items {
+		vs := &list.Items[i]
+		if routing.Owned(vs) || !routing.RoutesHost(vs, host, r.clusterDomain()) {
+			continue
+		}
+		if found == nil || vs.GetName() < found.GetName() {
+			found = vs
+		}
+	}
+	return found, nil
+}
+
+// hostServices returns the normalized LayerServices, of any namespace, which are valid, permitted to override host
+// and have a ready endpoint to serve them. Until they have one their layer's requests fall back to the parent.
+func (r *LayerServiceReconciler) hostServices(ctx context.Context, host, namespace string) ([]routelayerv1.LayerService, error) {
+	list := &routelayerv1.LayerServiceList{}
+	if err := r.List(ctx, list); err != nil {
+		return nil, err
+	}
+	clusters, err := r.clusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	services := []routelayerv1.LayerService{}
+	for _, item := range list.Items {
+		ls := routing.Normalize(item, r.clusterDomain())
+		if ls.Spec.Host != host {
+			continue
+		}
+		if _, hostNamespace := r.host(&item); hostNamespace != namespace {
+			// an external host overridden from another namespace is a different host.
+			continue
+		}
+		if validateLayerService(ls, r.clusterDomain(), r.egressGateway()) != "" {
+			continue
+		}
+		permitted, err := overridePermitted(ctx, r.Client, ls.Namespace, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if !permitted {
+			continue
+		}
+		ready, err := endpointsReady(ctx, clusters, ls, r.clusterDomain())
+		if err != nil {
+			return nil, err
+		}
+		if ready {
+			services = append(services, ls)
+		}
+	}
+	return services, nil
+}
+
+// reconcileTelemetry generates the Telemetry tagging requests with their layer in each of namespaces taking part
+// in layers: those with a LayerService, or a host routed by one. Requests are only tagged with the layers the
+// namespace may route. It is deleted from the others.
+func (r *LayerServiceReconciler) reconcileTelemetry(ctx context.Context, namespaces ...string) error {
+	list := &routelayerv1.LayerServiceList{}
+	if err := r.List(ctx, list); err != nil {
+		return err
+	}
+	participating := map[string]bool{}
+	for _, ls := range list.Items {
+		if !ls.DeletionTimestamp.IsZero() {
+			continue
+		}
+		_, hostNamespace := r.host(&ls)
+		participating[ls.Namespace] = true
+		participating[hostNamespace] = true
+	}
+	for _, namespace := range namespaces {
+		if !participating[namespace] {
+			if err := r.deleteIfExists(ctx, routing.NewTelemetry(routing.TelemetryName, namespace)); err != nil {
+				return err
+			}
+			continue
+		}
+		layers, err := r.routableLayers(ctx, namespace)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(layers))
+		for _, l := range layers {
+			names = append(names, l.Name)
+		}
+		slices.Sort(names)
+		if err := r.apply(ctx, routing.Telemetry(namespace, r.layerHeader(), r.AccessLogProvider, names)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routableLayers returns the layers LayerServices in namespace may route: the cluster Layers and the namespace's
+// own NamespaceLayers. A NamespaceLayer replaces a cluster Layer of the same name, and is left out
+// if its namespace is not permitted to attach to its parent.
+func (r *LayerServiceReconciler) routableLayers(ctx context.Context, namespace string) ([]routelayerv1.Layer, error) {
+	namespaceLayers := &routelayerv1.NamespaceLayerList{}
+	if err := r.List(ctx, namespaceLayers, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	layers := []routelayerv1.Layer{}
+	shadowed := map[string]bool{}
+	for _, nl := range namespaceLayers.Items {
+		if nl.Spec.Parent != "" {
+			permitted, err := attachPermitted(ctx, r.Client, namespace, nl.Spec.Parent)
+			if err != nil {
+				return nil, err
+			}
+			if !permitted {
+				continue
+			}
+		}
+		shadowed[nl.Name] = true
+		layers = append(layers, routelayerv1.Layer{ObjectMeta: nl.ObjectMeta, Spec: nl.Spec, Status: nl.Status})
+	}
+
+	clusterLayers := &routelayerv1.LayerList{}
+	if err := r.List(ctx, clusterLayers); err != nil {
+		return nil, err
+	}
+	for _, l := range clusterLayers.Items {
+		if !shadowed[l.Name] {
+			layers = append(layers, l)
+		}
+	}
+	return layers, nil
+}
+
+func (r *LayerServiceReconciler) layerHeader() string {
+	if r.LayerHeader == "" {
+		return routing.DefaultLayerHeader
+	}
+	return r.LayerHeader
+}
+
+func (r *LayerServiceReconciler) egressGateway() string {
+	if r.EgressGateway == "" {
+		return ""
+	}
+	return routing.FQDN(r.EgressGateway, routing.DefaultRootNamespace, r.clusterDomain())
+}
+
+func (r *LayerServiceReconciler) clusterDomain() string {
+	if r.ClusterDomain == "" {
+		return routing.DefaultClusterDomain
+	}
+	return r.ClusterDomain
+}
+
+func (r *LayerServiceReconciler) snapshotRevisions() int {
+	if r.SnapshotRevisions <= 0 {
+		return routing.DefaultSnapshotRevisions
+	}
+	return r.SnapshotRevisions
+}
+
+// applyGenerated server-side applies a generated resource. If someone else has changed the spec routelayer
+// last applied, the change is overwritten and described in the returned drift.
+func (r *LayerServiceReconciler) applyGenerated(ctx context.Context, desired *unstructured.Unstructured) (string, error) {
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(desired.GroupVersionKind())
+	drift := ""
+	err := r.Get(ctx, client.ObjectKeyFromObject(desired), existing)
+	if err != nil && !errors.IsNotFound(err) {
+		return "", err
+	}
+	if err == nil && routing.Drifted(existing) {
+		drift = fmt.Sprintf("%s %s was changed", existing.GetKind(), existing.GetName())
+		if writers := routing.Writers(existing); len(writers) > 0 {
+			drift += " by " + strings.Join(writers, ", ")
+		}
+	}
+	return drift, r.apply(ctx, desired)
+}
+
+// apply server-side applies the fields routelayer manages of a resource, taking them over from any other writer.
+func (r *LayerServiceReconciler) apply(ctx context.Context, obj *unstructured.Unstructured) error {
+	return r.Patch(ctx, obj, client.Apply, client.FieldOwner(routing.FieldManager), client.ForceOwnership)
+}
+
+func (r *LayerServiceReconciler) deleteIfExists(ctx context.Context, obj *unstructured.Unstructured) error {
+	return client.IgnoreNotFound(r.Delete(ctx, obj))
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+var _ = Describe("LayerService Reconciler", func() {
+	Context("When reconciling a LayerService", func() {
+		const (
+			resourceName = "test-layerservice"
+			layerName    = "test-layerservice-layer"
+			namespace    = "default"
+		)
+
+		ctx := context.Background()
+
+		namespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: namespace,
+		}
+
+		var ls *routelayerv1.LayerService
+
+		// istio is not installed in the test environment, so the reconciler runs with IstioEnabled false
+		// and only the validation and status handling is exercised here. The generated routes are tested
+		// in the routing package.
+
+		reconcile := func() *routelayerv1.LayerService {
+			lc := &LayerServiceReconciler{Client: k8sClient}
+			_, err := lc.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			l := &routelayerv1.LayerService{}
+			Expect(k8sClient.Get(ctx, namespacedName, l)).To(Succeed())
+			return l
+		}
+
+		// serve creates a ready endpoint of service, on a pod with the LayerService's labels, so it can be routed.
+		// It returns a func deleting them.
+		serve := func(service string) func() {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName + "-" + service,
+					Namespace: namespace,
+					Labels:    map[string]string{"version": "v2"},
+				},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "echo", Image: "hashicorp/http-echo"}}},
+			}
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			slice := &discoveryv1.EndpointSlice{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      pod.Name,
+					Namespace: namespace,
+					Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+				},
+				AddressType: discoveryv1.AddressTypeIPv4,
+				Endpoints: []discoveryv1.Endpoint{{
+					Addresses: []string{"10.0.0.2"},
+					TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: pod.Name, Namespace: namespace},
+				}},
+			}
+			Expect(k8sClient.Create(ctx, slice)).To(Succeed())
+			return func() {
+				Expect(k8sClient.Delete(ctx, slice)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, pod)).To(Succeed())
+			}
+		}
+
+		BeforeEach(func() {
+			ls = &routelayerv1.LayerService{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName,
+					Namespace: namespace,
+				},
+				Spec: routelayerv1.LayerServiceSpec{
+					Layer:  layerName,
+					Host:   "http-echo",
+					Labels: map[string]string{"version": "v2"},
+				},
+			}
+			Expect(k8sClient.Create(ctx, ls)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(k8sClient.Delete(ctx, ls)).To(Succeed())
+			lc := &LayerServiceReconciler{Client: k8sClient}
+			lc.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+		})
+
+		It("Should set the finalizer", func() {
+			l := reconcile()
+			Expect(l.Finalizers).To(ContainElement(RouteLayerFinalizer))
+		})
+
+		It("LayerService without its layer should be waiting", func() {
+			l := reconcile()
+			Expect(l.Status.State).To(Equal(WaitingState))
+		})
+
+		It("LayerService with its layer should be ready", func() {
+			layer := &routelayerv1.Layer{ObjectMeta: metav1.ObjectMeta{Name: layerName}}
+			Expect(k8sClient.Create(ctx, layer)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, layer)).To(Succeed())
+			}()
+			defer serve("http-echo")()
+
+			l := reconcile()
+			Expect(l.Status.State).To(Equal(ReadyState))
+			Expect(meta.IsStatusConditionTrue(l.Status.Conditions, EndpointsReadyCondition)).To(BeTrue())
+		})
+
+		It("LayerService should record the host it is routed for, as it changes", func() {
+			layer := &routelayerv1.Layer{ObjectMeta: metav1.ObjectMeta{Name: layerName}}
+			Expect(k8sClient.Create(ctx, layer)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, layer)).To(Succeed())
+			}()
+
+			l := reconcile()
+			Expect(l.Status.Host).To(Equal("http-echo.default.svc.cluster.local"))
+
+			By("changing the host, the one before is routed without the LayerService")
+			l.Spec.Host = "http-echo-admin"
+			Expect(k8sClient.Update(ctx, l)).To(Succeed())
+			l = reconcile()
+			Expect(l.Status.Host).To(Equal("http-echo-admin.default.svc.cluster.local"))
+		})
+
+		It("LayerService without a ready endpoint should be waiting", func() {
+			layer := &routelayerv1.Layer{ObjectMeta: metav1.ObjectMeta{Name: layerName}}
+			Expect(k8sClient.Create(ctx, layer)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, layer)).To(Succeed())
+			}()
+
+			l := reconcile()
+			Expect(l.Status.State).To(Equal(WaitingState))
+			Expect(meta.IsStatusConditionFalse(l.Status.Conditions, EndpointsReadyCondition)).To(BeTrue())
+
+			By("an endpoint of another subset becoming ready")
+			Expect(k8sClient.Get(ctx, namespacedName, ls)).To(Succeed())
+			ls.Spec.Labels = map[string]string{"version": "v3"}
+			Expect(k8sClient.Update(ctx, ls)).To(Succeed())
+			defer serve("http-echo")()
+
+			l = reconcile()
+			Expect(l.Status.State).To(Equal(WaitingState))
+		})
+
+		It("LayerService routing to its own host should be in error", func() {
+			ls.Spec.Destination = ls.Spec.Host
+			Expect(k8sClient.Update(ctx, ls)).To(Succeed())
+
+			l := reconcile()
+			Expect(l.Status.State).To(Equal(ErrorState))
+		})
+
+		It("LayerService selecting pods outside the cluster should be in error", func() {
+			ls.Spec.Destination = "sandbox.payments.example.com"
+			Expect(k8sClient.Update(ctx, ls)).To(Succeed())
+
+			l := reconcile()
+			Expect(l.Status.State).To(Equal(ErrorState))
+			Expect(l.Status.Message).To(ContainSubstring("outside the cluster"))
+		})
+
+		It("LayerService originating TLS to a cluster service should be in error", func() {
+			ls.Spec.Destination = "http-echo-v2"
+			ls.Spec.DestinationTLS = true
+			Expect(k8sClient.Update(ctx, ls)).To(Succeed())
+
+			l := reconcile()
+			Expect(l.Status.State).To(Equal(ErrorState))
+		})
+
+		It("LayerService leaving through an egress gateway should need a host outside the cluster", func() {
+			ls.Spec.Labels = nil
+			ls.Spec.Destination = "sandbox.payments.example.com"
+			ls.Spec.EgressGateway = "istio-egressgateway.istio-system"
+			Expect(k8sClient.Update(ctx, ls)).To(Succeed())
+
+			l := reconcile()
+			Expect(l.Status.State).To(Equal(ErrorState))
+			Expect(l.Status.Message).To(ContainSubstring("outside the cluster"))
+		})
+
+		It("LayerService overriding a host in another namespace should need a LayerPolicy", func() {
+			layer := &routelayerv1.Layer{ObjectMeta: metav1.ObjectMeta{Name: layerName}}
+			Expect(k8sClient.Create(ctx, layer)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, layer)).To(Succeed())
+			}()
+
+			ls.Spec.Host = "http-echo.routing-demo"
+			ls.Spec.Destination = "http-echo-v2." + namespace
+			Expect(k8sClient.Update(ctx, ls)).To(Succeed())
+			defer serve("http-echo-v2")()
+
+			l := reconcile()
+			Expect(l.Status.State).To(Equal(ErrorState))
+
+			policy := &routelayerv1.LayerPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-layerservice-policy"},
+				Spec: routelayerv1.LayerPolicySpec{
+					Rules: []routelayerv1.LayerPolicyRule{{Namespaces: []string{namespace}, HostNamespaces: []string{"routing-demo"}}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			}()
+
+			l = reconcile()
+			Expect(l.Status.State).To(Equal(ReadyState))
+		})
+
+		It("LayerService overriding a host in another namespace should not route its own NamespaceLayer", func() {
+			nl := &routelayerv1.NamespaceLayer{ObjectMeta: metav1.ObjectMeta{Name: layerName, Namespace: namespace}}
+			Expect(k8sClient.Create(ctx, nl)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, nl)).To(Succeed())
+			}()
+			policy := &routelayerv1.LayerPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-layerservice-policy"},
+				Spec: routelayerv1.LayerPolicySpec{
+					Rules: []routelayerv1.LayerPolicyRule{{Namespaces: []string{namespace}, HostNamespaces: []string{"routing-demo"}}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			}()
+
+			ls.Spec.Host = "http-echo.routing-demo"
+			ls.Spec.Destination = "http-echo-v2." + namespace
+			Expect(k8sClient.Update(ctx, ls)).To(Succeed())
+			defer serve("http-echo-v2")()
+
+			l := reconcile()
+			Expect(l.Status.State).To(Equal(WaitingState))
+			Expect(l.Status.Message).To(ContainSubstring("not routable in namespace routing-demo"))
+		})
+	})
+})
@@ -0,0 +1,238 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	controllerutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+	"github.com/fergalsomers/routelayer/internal/routing"
+	"github.com/go-logr/logr"
+)
+
+// NamespaceLayerReconciler reconciles a NamespaceLayer object
+type NamespaceLayerReconciler struct {
+	client.Client
+	Scheme       *runtime.Scheme
+	IstioEnabled bool // Whether integration with istio should be enabled or not. Defaults to false.
+	// LayerHeader is the request header used to select a layer. Defaults to routing.DefaultLayerHeader.
+	LayerHeader string
+	// ClusterDomain is the DNS domain of the cluster, used to normalize hosts. Defaults to routing.DefaultClusterDomain.
+	ClusterDomain string
+}
+
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=namespacelayers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=namespacelayers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=namespacelayers/finalizers,verbs=update
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=layerpolicies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=security.istio.io,resources=authorizationpolicies;requestauthentications,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile checks the NamespaceLayer's parent exists and that a LayerPolicy permits the namespace to attach to it.
+func (r *NamespaceLayerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	log := logger.WithValues("namespacelayer", req.NamespacedName)
+
+	layer := &routelayerv1.NamespaceLayer{}
+	if err := r.Get(ctx, req.NamespacedName, layer); err != nil {
+		log.Error(err, "unable to fetch NamespaceLayer")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if layer.ObjectMeta.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(layer, RouteLayerFinalizer) {
+			controllerutil.AddFinalizer(layer, RouteLayerFinalizer)
+			if err := r.Update(ctx, layer); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	} else {
+		if controllerutil.ContainsFinalizer(layer, RouteLayerFinalizer) {
+			if r.IstioEnabled {
+				if err := reconcileAccess(ctx, r.Client, layer.Name, nil, layer.Namespace, r.layerHeader(), nil, nil); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+			controllerutil.RemoveFinalizer(layer, RouteLayerFinalizer)
+			if err := r.Update(ctx, layer); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+
+	cntrl, err := r.createUpdateNamespaceLayer(ctx, layer, log)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.Status().Update(ctx, layer); err != nil {
+		return ctrl.Result{}, err
+	}
+	return cntrl, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// A NamespaceLayer's status aggregates its LayerServices', so they requeue their layer.
+func (r *NamespaceLayerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&routelayerv1.NamespaceLayer{}).
+		Watches(&routelayerv1.LayerService{}, handler.EnqueueRequestsFromMapFunc(r.serviceLayer)).
+		Named("namespacelayer").
+		Complete(r)
+}
+
+func (r *NamespaceLayerReconciler) serviceLayer(_ context.Context, obj client.Object) []reconcile.Request {
+	ls, ok := obj.(*routelayerv1.LayerService)
+	if !ok || ls.Spec.Layer == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: ls.Spec.Layer, Namespace: ls.Namespace}}}
+}
+
+func (r *NamespaceLayerReconciler) createUpdateNamespaceLayer(ctx context.Context, layer *routelayerv1.NamespaceLayer, log logr.Logger) (ctrl.Result, error) {
+	log.Info("create/update namespacelayer")
+
+	if layer.Spec.Parent != "" {
+		permitted, err := attachPermitted(ctx, r.Client, layer.Namespace, layer.Spec.Parent)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !permitted {
+			layer.Status.Message = fmt.Sprintf("No LayerPolicy permits namespace %s to attach to Layer %s",
+				layer.Namespace, layer.Spec.Parent)
+			layer.Status.State = ErrorState
+			return ctrl.Result{}, nil
+		}
+
+		parent := &routelayerv1.Layer{}
+		if err := r.Get(ctx, types.NamespacedName{Name: layer.Spec.Parent}, parent); err != nil {
+			layer.Status.Message = fmt.Sprintf("Parent Layer %s not found", layer.Spec.Parent)
+			layer.Status.State = WaitingState
+
+			return ctrl.Result{
+				RequeueAfter: defaultWait,
+			}, nil
+		}
+	}
+
+	if msg := validateAccess(layer.Spec.Access); msg != "" {
+		layer.Status.Message = msg
+		layer.Status.State = ErrorState
+		return ctrl.Result{}, nil
+	}
+
+	if msg := validateEnrollment(layer.Name, layer.Spec.Enrollment); msg != "" {
+		layer.Status.Message = msg
+		layer.Status.State = ErrorState
+		return ctrl.Result{}, nil
+	}
+
+	if r.IstioEnabled {
+		if err := reconcileAccess(ctx, r.Client, layer.Name, nil, layer.Namespace, r.layerHeader(), nil, layer.Spec.Access); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	notReady, err := aggregateServices(ctx, r.Client, r.clusterDomain(), layer.Name,
+		func(ls routelayerv1.LayerService) bool { return ls.Namespace == layer.Namespace }, &layer.Status)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if layer.Spec.Suspend {
+		layer.Status.Message = "Layer suspended, its LayerServices are not routed"
+		layer.Status.State = SuspendedState
+		return ctrl.Result{}, nil
+	}
+
+	if len(notReady) > 0 {
+		layer.Status.Message = fmt.Sprintf("%d of %d LayerServices ready: %s",
+			layer.Status.ReadyServices, layer.Status.Services, strings.Join(notReady, "; "))
+		layer.Status.State = WaitingState
+		return ctrl.Result{}, nil
+	}
+
+	layer.Status.Message = "Layer created"
+	layer.Status.State = ReadyState
+
+	log.Info("namespacelayer", "resourceVersion", layer.ObjectMeta.ResourceVersion, "state", layer.Status.State)
+
+	return ctrl.Result{}, nil
+}
+
+func (r *NamespaceLayerReconciler) clusterDomain() string {
+	if r.ClusterDomain == "" {
+		return routing.DefaultClusterDomain
+	}
+	return r.ClusterDomain
+}
+
+func (r *NamespaceLayerReconciler) layerHeader() string {
+	if r.LayerHeader == "" {
+		return routing.DefaultLayerHeader
+	}
+	return r.LayerHeader
+}
+
+// attachPermitted returns true if any LayerPolicy allows NamespaceLayers in namespace to attach to the cluster Layer.
+func attachPermitted(ctx context.Context, c client.Client, namespace, layer string) (bool, error) {
+	return policyPermits(ctx, c, namespace, func(rule routelayerv1.LayerPolicyRule) bool {
+		return matchesAny(rule.Layers, layer)
+	})
+}
+
+// overridePermitted returns true if LayerServices in namespace may override the hosts of hostNamespace.
+func overridePermitted(ctx context.Context, c client.Client, namespace, hostNamespace string) (bool, error) {
+	if namespace == hostNamespace {
+		return true, nil
+	}
+	return policyPermits(ctx, c, namespace, func(rule routelayerv1.LayerPolicyRule) bool {
+		return matchesAny(rule.HostNamespaces, hostNamespace)
+	})
+}
+
+// policyPermits returns true if any rule, of any LayerPolicy, for namespace allows it.
+func policyPermits(ctx context.Context, c client.Client, namespace string, allows func(routelayerv1.LayerPolicyRule) bool) (bool, error) {
+	policies := &routelayerv1.LayerPolicyList{}
+	if err := c.List(ctx, policies); err != nil {
+		return false, err
+	}
+	for _, p := range policies.Items {
+		for _, rule := range p.Spec.Rules {
+			if matchesAny(rule.Namespaces, namespace) && allows(rule) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	return slices.Contains(patterns, "*") || slices.Contains(patterns, name)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+var _ = Describe("NamespaceLayer Reconciler", func() {
+	Context("When reconciling a NamespaceLayer", func() {
+		const (
+			resourceName = "test-namespacelayer"
+			parentName   = "test-namespacelayer-parent"
+			namespace    = "default"
+		)
+
+		ctx := context.Background()
+
+		namespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: namespace,
+		}
+
+		var layer *routelayerv1.NamespaceLayer
+		var parent *routelayerv1.Layer
+
+		reconcile := func() *routelayerv1.NamespaceLayer {
+			lc := &NamespaceLayerReconciler{Client: k8sClient}
+			_, err := lc.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			l := &routelayerv1.NamespaceLayer{}
+			Expect(k8sClient.Get(ctx, namespacedName, l)).To(Succeed())
+			return l
+		}
+
+		BeforeEach(func() {
+			parent = &routelayerv1.Layer{ObjectMeta: metav1.ObjectMeta{Name: parentName}}
+			Expect(k8sClient.Create(ctx, parent)).To(Succeed())
+
+			layer = &routelayerv1.NamespaceLayer{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName,
+					Namespace: namespace,
+				},
+				Spec: routelayerv1.LayerSpec{Parent: parentName},
+			}
+			Expect(k8sClient.Create(ctx, layer)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(k8sClient.Delete(ctx, layer)).To(Succeed())
+			lc := &NamespaceLayerReconciler{Client: k8sClient}
+			lc.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(k8sClient.Delete(ctx, parent)).To(Succeed())
+		})
+
+		It("NamespaceLayer without a LayerPolicy should be in error", func() {
+			l := reconcile()
+			Expect(l.Finalizers).To(ContainElement(RouteLayerFinalizer))
+			Expect(l.Status.State).To(Equal(ErrorState))
+		})
+
+		It("NamespaceLayer permitted by a LayerPolicy should be ready", func() {
+			policy := &routelayerv1.LayerPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-namespacelayer-policy"},
+				Spec: routelayerv1.LayerPolicySpec{
+					Rules: []routelayerv1.LayerPolicyRule{{Namespaces: []string{namespace}, Layers: []string{"*"}}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			}()
+
+			l := reconcile()
+			Expect(l.Status.State).To(Equal(ReadyState))
+		})
+
+		It("NamespaceLayer permitted for another namespace should be in error", func() {
+			policy := &routelayerv1.LayerPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-namespacelayer-policy"},
+				Spec: routelayerv1.LayerPolicySpec{
+					Rules: []routelayerv1.LayerPolicyRule{{Namespaces: []string{"team-b"}, Layers: []string{parentName}}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			}()
+
+			l := reconcile()
+			Expect(l.Status.State).To(Equal(ErrorState))
+		})
+	})
+})
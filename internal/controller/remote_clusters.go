@@ -0,0 +1,201 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/fergalsomers/routelayer/internal/routing"
+)
+
+// The Secrets are only read in the manager's namespace, as kustomize sets it, so --remote-clusters-namespace must be
+// that namespace unless a Role for another is bound.
+// +kubebuilder:rbac:groups="",namespace=system,resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+
+// clusters returns the clients of the clusters of the mesh, this one first then the remote clusters by name.
+// Remote clusters which can't be connected to are logged and left out.
+func (r *LayerServiceReconciler) clusters(ctx context.Context) ([]client.Client, error) {
+	clients := []client.Client{r.Client}
+	if r.Remotes == nil {
+		return clients, nil
+	}
+	remotes, err := r.Remotes.Clients(ctx)
+	if remotes == nil && err != nil {
+		return nil, err
+	}
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to connect to remote clusters")
+	}
+	for _, name := range sortedKeys(remotes) {
+		clients = append(clients, remotes[name])
+	}
+	return clients, nil
+}
+
+// reconcileRemotes programs the table's routes in the remote clusters, and makes the cluster services its layers
+// route to known, with ServiceEntries, in the clusters which don't have them - this one included.
+// A remote cluster which can't be programmed doesn't stop the others, it is reported in the returned messages.
+func (r *LayerServiceReconciler) reconcileRemotes(ctx context.Context, t routing.Table,
+	selectors map[string]map[string]string) ([]string, error) {
+	failed := []string{}
+	remotes, err := r.Remotes.Clients(ctx)
+	if remotes == nil && err != nil {
+		return nil, err
+	}
+	if err != nil {
+		failed = append(failed, err.Error())
+	}
+	clusters := map[string]client.Client{"": r.Client}
+	for name, c := range remotes {
+		clusters[name] = c
+	}
+
+	entries, unreachable := r.serviceEntries(ctx, t, clusters)
+	for _, name := range sortedKeys(clusters) {
+		if err, ok := unreachable[name]; ok {
+			if name == "" {
+				return nil, err
+			}
+			failed = append(failed, fmt.Sprintf("cluster %s: %v", name, err))
+			continue
+		}
+		desired := append(entries[name], r.externalResources(t, selectors)...)
+		if name != "" && len(t.Routes) > 0 {
+			desired = append(desired, routing.VirtualService(t, r.layerHeader()))
+			if dr := routing.DestinationRule(t); dr != nil {
+				desired = append(desired, dr)
+			}
+		}
+		if err := r.syncCluster(ctx, clusters[name], t, desired, name != ""); err != nil {
+			if name == "" {
+				return nil, err
+			}
+			failed = append(failed, fmt.Sprintf("cluster %s: %v", name, err))
+		}
+	}
+	return failed, nil
+}
+
+// serviceEntries returns the ServiceEntries each cluster needs for the table's destinations, those cluster services
+// which live in other clusters of the mesh. It also returns the clusters which couldn't be read.
+func (r *LayerServiceReconciler) serviceEntries(ctx context.Context, t routing.Table,
+	clusters map[string]client.Client) (map[string][]*unstructured.Unstructured, map[string]error) {
+	entries := map[string][]*unstructured.Unstructured{}
+	unreachable := map[string]error{}
+	seen := map[string]bool{}
+	for _, route := range t.Routes {
+		destination := route.Destination
+		namespace, ok := routing.HostNamespace(destination, r.clusterDomain())
+		if destination == t.Host || !ok || seen[destination] {
+			continue
+		}
+		seen[destination] = true
+		name, _, _ := strings.Cut(destination, ".")
+
+		var svc *corev1.Service
+		slices := []discoveryv1.EndpointSlice{}
+		lacking := []string{}
+		for _, cluster := range sortedKeys(clusters) {
+			if _, ok := unreachable[cluster]; ok {
+				continue
+			}
+			c := clusters[cluster]
+			s := &corev1.Service{}
+			if err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, s); err != nil {
+				if errors.IsNotFound(err) {
+					lacking = append(lacking, cluster)
+				} else {
+					unreachable[cluster] = err
+				}
+				continue
+			}
+			if svc == nil {
+				svc = s
+			}
+			list := &discoveryv1.EndpointSliceList{}
+			if err := c.List(ctx, list, client.InNamespace(namespace),
+				client.MatchingLabels{discoveryv1.LabelServiceName: name}); err != nil {
+				unreachable[cluster] = err
+				continue
+			}
+			slices = append(slices, list.Items...)
+		}
+		if svc == nil {
+			// it lives in no cluster, so isn't routed.
+			continue
+		}
+		for _, cluster := range lacking {
+			entries[cluster] = append(entries[cluster], routing.ServiceEntry(t.Host, t.Namespace, destination, svc, slices))
+		}
+	}
+	return entries, unreachable
+}
+
+// syncCluster applies the desired resources for the table's host in a cluster, and deletes those generated for it
+// before which are no longer desired. The host's own VirtualService and DestinationRule in this cluster are left
+// to reconcileHost.
+func (r *LayerServiceReconciler) syncCluster(ctx context.Context, c client.Client, t routing.Table,
+	desired []*unstructured.Unstructured, remote bool) error {
+	keep := map[string]bool{}
+	if !remote {
+		keep[routing.VirtualServiceGVK.Kind+"/"+routing.Name(t.Host)] = true
+		keep[routing.DestinationRuleGVK.Kind+"/"+routing.Name(t.Host)] = true
+	}
+	for _, obj := range desired {
+		if err := c.Patch(ctx, obj, client.Apply, client.FieldOwner(routing.FieldManager), client.ForceOwnership); err != nil {
+			return err
+		}
+		keep[obj.GetKind()+"/"+obj.GetName()] = true
+	}
+
+	stale := []*unstructured.Unstructured{}
+	for _, gvk := range []schema.GroupVersionKind{routing.VirtualServiceGVK, routing.DestinationRuleGVK,
+		routing.ServiceEntryGVK, routing.GatewayGVK} {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		if err := c.List(ctx, list, client.InNamespace(t.Namespace),
+			client.MatchingLabels{routing.ManagedByLabel: routing.ManagedByValue}); err != nil {
+			return err
+		}
+		for i := range list.Items {
+			if obj := &list.Items[i]; obj.GetAnnotations()[routing.HostAnnotation] == t.Host {
+				stale = append(stale, obj)
+			}
+		}
+	}
+	for _, obj := range stale {
+		if keep[obj.GetKind()+"/"+obj.GetName()] {
+			continue
+		}
+		if err := client.IgnoreNotFound(c.Delete(ctx, obj)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+	"github.com/fergalsomers/routelayer/internal/remote"
+	"github.com/fergalsomers/routelayer/internal/routing"
+)
+
+var _ = Describe("Remote clusters", func() {
+	const namespace = "default"
+
+	ctx := context.Background()
+
+	// a second control plane plays the remote cluster of the mesh.
+	var remoteEnv *envtest.Environment
+	var remoteClient client.Client
+	var secret *corev1.Secret
+
+	BeforeEach(func() {
+		remoteEnv = &envtest.Environment{
+			BinaryAssetsDirectory: filepath.Join("..", "..", "bin", "k8s",
+				fmt.Sprintf("1.31.0-%s-%s", runtime.GOOS, runtime.GOARCH)),
+		}
+		remoteCfg, err := remoteEnv.Start()
+		Expect(err).NotTo(HaveOccurred())
+		remoteClient, err = client.New(remoteCfg, client.Options{Scheme: scheme.Scheme})
+		Expect(err).NotTo(HaveOccurred())
+
+		user, err := remoteEnv.AddUser(envtest.User{Name: "routelayer", Groups: []string{"system:masters"}}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		kubeconfig, err := user.KubeConfig()
+		Expect(err).NotTo(HaveOccurred())
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-remote-west",
+				Namespace: namespace,
+				Labels:    map[string]string{remote.SecretLabel: "true"},
+			},
+			Data: map[string][]byte{"west": kubeconfig},
+		}
+		Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(k8sClient.Delete(ctx, secret)).To(Succeed())
+		Expect(remoteEnv.Stop()).To(Succeed())
+	})
+
+	It("should find the endpoints and services of a destination in the remote cluster", func() {
+		r := &LayerServiceReconciler{
+			Client:  k8sClient,
+			Scheme:  k8sClient.Scheme(),
+			Remotes: &remote.Clusters{Reader: k8sClient, Namespace: namespace, Scheme: k8sClient.Scheme()},
+		}
+		clusters, err := r.clusters(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clusters).To(HaveLen(2))
+
+		ls := routing.Normalize(routelayerv1.LayerService{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-remote", Namespace: namespace},
+			Spec:       routelayerv1.LayerServiceSpec{Layer: "test-remote", Host: "echo", Destination: "echo-west"},
+		}, routing.DefaultClusterDomain)
+		ready, err := endpointsReady(ctx, clusters, ls, routing.DefaultClusterDomain)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeFalse())
+
+		By("the destination being served in the remote cluster only")
+		svc := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "echo-west", Namespace: namespace},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 80}}},
+		}
+		Expect(remoteClient.Create(ctx, svc)).To(Succeed())
+		slice := &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "echo-west",
+				Namespace: namespace,
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "echo-west"},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"10.1.0.7"}}},
+		}
+		Expect(remoteClient.Create(ctx, slice)).To(Succeed())
+
+		ready, err = endpointsReady(ctx, clusters, ls, routing.DefaultClusterDomain)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeTrue())
+
+		t := routing.BuildTable(ls.Spec.Host, namespace, []routelayerv1.LayerService{ls},
+			[]routelayerv1.Layer{{ObjectMeta: metav1.ObjectMeta{Name: "test-remote"}}})
+		remotes, err := r.Remotes.Clients(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		entries, unreachable := r.serviceEntries(ctx, t, map[string]client.Client{"": k8sClient, "west": remotes["west"]})
+		Expect(unreachable).To(BeEmpty())
+		Expect(entries).To(HaveKey(""), "this cluster doesn't have the destination")
+		Expect(entries).NotTo(HaveKey("west"))
+		endpoints, _, _ := unstructured.NestedSlice(entries[""][0].Object, "spec", "endpoints")
+		Expect(endpoints).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,204 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+	"github.com/fergalsomers/routelayer/internal/routing"
+	"github.com/go-logr/logr"
+)
+
+// RouteRollbackReconciler reconciles a RouteRollback object.
+// It only finds the snapshots the hosts are rolled back to, the LayerServiceReconciler routes them.
+type RouteRollbackReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=routerollbacks,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=routelayer.github.com,resources=routerollbacks/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+
+// Reconcile finds the route table snapshot each host covered by the RouteRollback is rolled back to.
+func (r *RouteRollbackReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	log := logger.WithValues("routerollback", req.NamespacedName)
+
+	rollback := &routelayerv1.RouteRollback{}
+	if err := r.Get(ctx, req.NamespacedName, rollback); err != nil {
+		log.Error(err, "unable to fetch RouteRollback")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !rollback.ObjectMeta.DeletionTimestamp.IsZero() {
+		// deleting the RouteRollback clears it, the LayerServices route their hosts again.
+		return ctrl.Result{}, nil
+	}
+
+	cntrl, err := r.createUpdateRouteRollback(ctx, rollback, log)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.Status().Update(ctx, rollback); err != nil {
+		return ctrl.Result{}, err
+	}
+	return cntrl, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// Snapshots which are deleted requeue the RouteRollbacks, so they report the hosts whose snapshot is missing.
+func (r *RouteRollbackReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&routelayerv1.RouteRollback{}).
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.allRollbacks),
+			builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+				return obj.GetLabels()[routing.SnapshotLabel] != ""
+			}))).
+		Named("routerollback").
+		Complete(r)
+}
+
+func (r *RouteRollbackReconciler) allRollbacks(ctx context.Context, _ client.Object) []reconcile.Request {
+	list := &routelayerv1.RouteRollbackList{}
+	if err := r.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list RouteRollbacks")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, rb := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: rb.Name}})
+	}
+	return requests
+}
+
+// createUpdateRouteRollback finds the snapshot each host is rolled back to. A host whose snapshot was found before
+// but no longer exists, and has no other to roll back to, is kept and reported missing, rather than quietly
+// dropped from the rollback.
+func (r *RouteRollbackReconciler) createUpdateRouteRollback(ctx context.Context, rollback *routelayerv1.RouteRollback, log logr.Logger) (ctrl.Result, error) {
+	log.Info("create/update routerollback")
+
+	if msg := validateRouteRollback(rollback); msg != "" {
+		rollback.Status.Message = msg
+		rollback.Status.State = ErrorState
+		rollback.Status.Hosts = nil
+		return ctrl.Result{}, nil
+	}
+
+	selector := client.MatchingLabels{routing.ManagedByLabel: routing.ManagedByValue}
+	if rollback.Spec.Host != "" {
+		selector = routing.SnapshotLabels(rollback.Spec.Host)
+	}
+	list := &corev1.ConfigMapList{}
+	if err := r.List(ctx, list, selector, client.HasLabels{routing.SnapshotLabel}); err != nil {
+		return ctrl.Result{}, err
+	}
+	snapshots := map[string][]corev1.ConfigMap{}
+	for _, cm := range list.Items {
+		host := cm.Annotations[routing.HostAnnotation]
+		snapshots[host] = append(snapshots[host], cm)
+	}
+
+	hosts := []routelayerv1.RolledBackHost{}
+	for _, host := range sortedKeys(snapshots) {
+		routing.SortSnapshots(snapshots[host])
+		i := slices.IndexFunc(snapshots[host], func(cm corev1.ConfigMap) bool {
+			if rollback.Spec.Before != nil {
+				return !cm.CreationTimestamp.After(rollback.Spec.Before.Time)
+			}
+			revision, _ := routing.Revision(&cm)
+			return revision == rollback.Spec.Revision
+		})
+		if i < 0 {
+			continue
+		}
+		cm := snapshots[host][i]
+		revision, _ := routing.Revision(&cm)
+		hosts = append(hosts, routelayerv1.RolledBackHost{
+			Host:      host,
+			Namespace: cm.Namespace,
+			Revision:  revision,
+			Snapshot:  cm.Name,
+		})
+	}
+	missing := []string{}
+	for _, previous := range rollback.Status.Hosts {
+		if rollback.Spec.Host != "" && previous.Host != rollback.Spec.Host ||
+			slices.ContainsFunc(hosts, func(h routelayerv1.RolledBackHost) bool { return h.Host == previous.Host }) {
+			continue
+		}
+		previous.Missing = true
+		hosts = append(hosts, previous)
+		missing = append(missing, fmt.Sprintf("%s (%s)", previous.Snapshot, previous.Host))
+	}
+	slices.SortFunc(hosts, func(a, b routelayerv1.RolledBackHost) int { return strings.Compare(a.Host, b.Host) })
+	rollback.Status.Hosts = hosts
+
+	if len(hosts) == 0 {
+		rollback.Status.Message = "No route table snapshot to roll back to"
+		rollback.Status.State = ErrorState
+		return ctrl.Result{}, nil
+	}
+
+	if len(missing) > 0 {
+		rollback.Status.Message = fmt.Sprintf("%d hosts rolled back, the snapshots of %d no longer exist, "+
+			"they are routed from their LayerServices: %s", len(hosts)-len(missing), len(missing), strings.Join(missing, ", "))
+		rollback.Status.State = ErrorState
+		return ctrl.Result{}, nil
+	}
+
+	rollback.Status.Message = fmt.Sprintf("%d hosts rolled back", len(hosts))
+	rollback.Status.State = ReadyState
+
+	log.Info("routerollback", "resourceVersion", rollback.ObjectMeta.ResourceVersion, "state", rollback.Status.State)
+
+	return ctrl.Result{}, nil
+}
+
+func validateRouteRollback(rollback *routelayerv1.RouteRollback) string {
+	if (rollback.Spec.Revision == 0) == (rollback.Spec.Before == nil) {
+		return "Exactly one of revision or before must be specified"
+	}
+	if rollback.Spec.Revision != 0 && rollback.Spec.Host == "" {
+		return "Host must be specified with a revision"
+	}
+	return ""
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
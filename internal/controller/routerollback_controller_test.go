@@ -0,0 +1,127 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+	"github.com/fergalsomers/routelayer/internal/routing"
+)
+
+var _ = Describe("RouteRollback Reconciler", func() {
+	Context("When reconciling a RouteRollback", func() {
+		const (
+			resourceName = "test-routerollback"
+			host         = "http-echo.default.svc.cluster.local"
+		)
+
+		ctx := context.Background()
+
+		namespacedName := types.NamespacedName{Name: resourceName}
+
+		var rollback *routelayerv1.RouteRollback
+
+		reconcile := func() *routelayerv1.RouteRollback {
+			rc := &RouteRollbackReconciler{Client: k8sClient}
+			_, err := rc.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			rb := &routelayerv1.RouteRollback{}
+			Expect(k8sClient.Get(ctx, namespacedName, rb)).To(Succeed())
+			return rb
+		}
+
+		BeforeEach(func() {
+			for revision := int64(1); revision <= 2; revision++ {
+				snapshot, err := routing.NewSnapshot(routing.Table{Host: host, Namespace: "default"}, revision)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(k8sClient.Create(ctx, snapshot)).To(Succeed())
+			}
+			rollback = &routelayerv1.RouteRollback{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName},
+				Spec:       routelayerv1.RouteRollbackSpec{Host: host, Revision: 1},
+			}
+		})
+
+		AfterEach(func() {
+			Expect(k8sClient.Delete(ctx, rollback)).To(Succeed())
+			for revision := int64(1); revision <= 2; revision++ {
+				snapshot, err := routing.NewSnapshot(routing.Table{Host: host, Namespace: "default"}, revision)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, snapshot))).To(Succeed())
+			}
+		})
+
+		It("RouteRollback to a revision should find its snapshot", func() {
+			Expect(k8sClient.Create(ctx, rollback)).To(Succeed())
+
+			rb := reconcile()
+			Expect(rb.Status.State).To(Equal(ReadyState))
+			Expect(rb.Status.Hosts).To(Equal([]routelayerv1.RolledBackHost{{
+				Host:      host,
+				Namespace: "default",
+				Revision:  1,
+				Snapshot:  routing.SnapshotName(host, 1),
+			}}))
+		})
+
+		It("RouteRollback whose snapshot is deleted should report it missing", func() {
+			Expect(k8sClient.Create(ctx, rollback)).To(Succeed())
+			Expect(reconcile().Status.State).To(Equal(ReadyState))
+
+			snapshot, err := routing.NewSnapshot(routing.Table{Host: host, Namespace: "default"}, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Delete(ctx, snapshot)).To(Succeed())
+
+			rb := reconcile()
+			Expect(rb.Status.State).To(Equal(ErrorState))
+			Expect(rb.Status.Message).To(ContainSubstring(routing.SnapshotName(host, 1)))
+			Expect(rb.Status.Hosts).To(Equal([]routelayerv1.RolledBackHost{{
+				Host:      host,
+				Namespace: "default",
+				Revision:  1,
+				Snapshot:  routing.SnapshotName(host, 1),
+				Missing:   true,
+			}}))
+		})
+
+		It("RouteRollback to a revision which was not kept should be in error", func() {
+			rollback.Spec.Revision = 5
+			Expect(k8sClient.Create(ctx, rollback)).To(Succeed())
+
+			rb := reconcile()
+			Expect(rb.Status.State).To(Equal(ErrorState))
+		})
+
+		It("RouteRollback with a revision but no host should be in error", func() {
+			rollback.Spec.Host = ""
+			Expect(k8sClient.Create(ctx, rollback)).To(Succeed())
+
+			rb := reconcile()
+			Expect(rb.Status.State).To(Equal(ErrorState))
+		})
+	})
+})
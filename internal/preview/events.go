@@ -0,0 +1,132 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package preview
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrUnauthorized is returned for events whose signature or token does not match the secret.
+	ErrUnauthorized = errors.New("event signature does not match the secret")
+	// ErrIgnored is returned for events which do not open, update or close a pull request.
+	ErrIgnored = errors.New("event ignored")
+)
+
+// Event is a pull request being opened, updated or closed.
+type Event struct {
+	// Number of the pull request (the iid of a GitLab merge request).
+	Number int
+	// Commit - SHA of the head commit.
+	Commit string
+	// Branch the pull request is from.
+	Branch string
+	// Closed is true when the pull request was closed or merged, its preview layer is deleted.
+	Closed bool
+}
+
+// Parse reads a GitHub pull_request or GitLab merge request event. A GitHub event must be signed with the secret
+// (X-Hub-Signature-256) and a GitLab event must carry it (X-Gitlab-Token), no event is accepted without a secret.
+func Parse(header http.Header, body []byte, secret []byte) (Event, error) {
+	switch {
+	case header.Get("X-GitHub-Event") != "":
+		if len(secret) == 0 || !validSignature(header.Get("X-Hub-Signature-256"), body, secret) {
+			return Event{}, ErrUnauthorized
+		}
+		if header.Get("X-GitHub-Event") != "pull_request" {
+			return Event{}, ErrIgnored
+		}
+		return parseGitHub(body)
+	case header.Get("X-Gitlab-Event") != "":
+		if len(secret) == 0 || subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), secret) != 1 {
+			return Event{}, ErrUnauthorized
+		}
+		if header.Get("X-Gitlab-Event") != "Merge Request Hook" {
+			return Event{}, ErrIgnored
+		}
+		return parseGitLab(body)
+	}
+	return Event{}, ErrIgnored
+}
+
+func parseGitHub(body []byte) (Event, error) {
+	var payload struct {
+		Action      string `json:"action"`
+		Number      int    `json:"number"`
+		PullRequest struct {
+			Head struct {
+				SHA string `json:"sha"`
+				Ref string `json:"ref"`
+			} `json:"head"`
+		} `json:"pull_request"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Event{}, err
+	}
+	ev := Event{Number: payload.Number, Commit: payload.PullRequest.Head.SHA, Branch: payload.PullRequest.Head.Ref}
+	switch payload.Action {
+	case "opened", "reopened", "synchronize":
+	case "closed":
+		ev.Closed = true
+	default:
+		return Event{}, ErrIgnored
+	}
+	return ev, nil
+}
+
+func parseGitLab(body []byte) (Event, error) {
+	var payload struct {
+		ObjectAttributes struct {
+			IID          int    `json:"iid"`
+			Action       string `json:"action"`
+			SourceBranch string `json:"source_branch"`
+			LastCommit   struct {
+				ID string `json:"id"`
+			} `json:"last_commit"`
+		} `json:"object_attributes"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Event{}, err
+	}
+	attrs := payload.ObjectAttributes
+	ev := Event{Number: attrs.IID, Commit: attrs.LastCommit.ID, Branch: attrs.SourceBranch}
+	switch attrs.Action {
+	case "open", "reopen", "update":
+	case "close", "merge":
+		ev.Closed = true
+	default:
+		return Event{}, ErrIgnored
+	}
+	return ev, nil
+}
+
+func validSignature(signature string, body, secret []byte) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package preview
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	githubEvent = `{"action":"synchronize","number":42,"pull_request":{"head":{"sha":"0a1b2c3d","ref":"feature-x"}}}`
+	gitlabEvent = `{"object_attributes":{"iid":7,"action":"merge","source_branch":"feature-y","last_commit":{"id":"4e5f6a7b"}}}`
+)
+
+var secret = []byte("s3cret")
+
+func sign(body string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func githubHeader(event, signature string) http.Header {
+	h := http.Header{}
+	h.Set("X-GitHub-Event", event)
+	h.Set("X-Hub-Signature-256", signature)
+	return h
+}
+
+var _ = Describe("Pull request events", func() {
+	It("should parse a signed GitHub pull request event", func() {
+		ev, err := Parse(githubHeader("pull_request", sign(githubEvent)), []byte(githubEvent), secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ev).To(Equal(Event{Number: 42, Commit: "0a1b2c3d", Branch: "feature-x"}))
+	})
+
+	It("should reject a GitHub event not signed with the secret", func() {
+		_, err := Parse(githubHeader("pull_request", sign("{}")), []byte(githubEvent), secret)
+		Expect(err).To(MatchError(ErrUnauthorized))
+	})
+
+	It("should parse a GitLab merge request event carrying the secret", func() {
+		h := http.Header{}
+		h.Set("X-Gitlab-Event", "Merge Request Hook")
+		h.Set("X-Gitlab-Token", string(secret))
+		ev, err := Parse(h, []byte(gitlabEvent), secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ev).To(Equal(Event{Number: 7, Commit: "4e5f6a7b", Branch: "feature-y", Closed: true}))
+
+		h.Set("X-Gitlab-Token", "guess")
+		_, err = Parse(h, []byte(gitlabEvent), secret)
+		Expect(err).To(MatchError(ErrUnauthorized))
+	})
+
+	It("should reject every event without a secret", func() {
+		_, err := Parse(githubHeader("pull_request", sign(githubEvent)), []byte(githubEvent), nil)
+		Expect(err).To(MatchError(ErrUnauthorized))
+		h := http.Header{}
+		h.Set("X-Gitlab-Event", "Merge Request Hook")
+		_, err = Parse(h, []byte(gitlabEvent), nil)
+		Expect(err).To(MatchError(ErrUnauthorized))
+	})
+
+	It("should ignore other events and actions", func() {
+		_, err := Parse(githubHeader("push", sign("{}")), []byte("{}"), secret)
+		Expect(err).To(MatchError(ErrIgnored))
+		labeled := `{"action":"labeled","number":42}`
+		_, err = Parse(githubHeader("pull_request", sign(labeled)), []byte(labeled), secret)
+		Expect(err).To(MatchError(ErrIgnored))
+	})
+})
+
+var _ = Describe("Receiver", func() {
+	r := &Receiver{Template: "preview", Secret: secret}
+
+	post := func(header http.Header, body string) int {
+		req := httptest.NewRequest(http.MethodPost, Path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	It("should name preview layers after the pull request", func() {
+		Expect(r.LayerName(42)).To(Equal("pr-42"))
+		Expect((&Receiver{Prefix: "shop"}).LayerName(42)).To(Equal("shop-42"))
+	})
+
+	It("should refuse unsigned events", func() {
+		Expect(post(githubHeader("pull_request", ""), githubEvent)).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should accept but ignore events which are not for pull requests", func() {
+		Expect(post(githubHeader("ping", sign("{}")), "{}")).To(Equal(http.StatusAccepted))
+	})
+
+	It("should only accept POSTs", func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, Path, nil))
+		Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
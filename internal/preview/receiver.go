@@ -0,0 +1,178 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package preview receives pull request events from GitHub or GitLab and keeps a preview Layer for each
+// open pull request, stamped out from a LayerTemplate.
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	controllerutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+const (
+	// PullRequestLabel records the number of the pull request a preview Layer is for.
+	PullRequestLabel = "routelayer.github.com/pull-request"
+	// CommitLabel records the head commit of the pull request a preview Layer was last updated for.
+	CommitLabel = "routelayer.github.com/commit"
+	// DefaultPrefix is prefixed to the pull request number to name its Layer.
+	DefaultPrefix = "pr"
+	// Path the events are received on.
+	Path = "/previews"
+
+	maxEventSize = 10 << 20
+)
+
+// Receiver keeps a preview Layer for each open pull request. The Layer refers to the Template, with the
+// parameters "pr", "commit" and "branch" set when the template has them.
+// It is a manager Runnable serving the events on Addr.
+type Receiver struct {
+	Client client.Client
+	// Addr the events are served on, e.g. ":8082".
+	Addr string
+	// Template - the LayerTemplate the preview Layers use.
+	Template string
+	// Parent of the preview Layers, none by default.
+	Parent string
+	// Prefix of the preview Layer names, DefaultPrefix by default.
+	Prefix string
+	// Secret GitHub events are signed with, and GitLab events carry. It is required, anyone able to reach Addr
+	// could otherwise create and delete Layers.
+	Secret []byte
+}
+
+// Start serves the events until ctx is done.
+func (r *Receiver) Start(ctx context.Context) error {
+	if len(r.Secret) == 0 {
+		return errors.New("a secret is required to receive pull request events")
+	}
+	mux := http.NewServeMux()
+	mux.Handle(Path, r)
+	srv := &http.Server{Addr: r.Addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+	log.FromContext(ctx).Info("serving preview events", "addr", r.Addr, "path", Path)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// NeedLeaderElection is false, the events may be sent to any replica of the manager.
+func (r *Receiver) NeedLeaderElection() bool {
+	return false
+}
+
+// ServeHTTP creates, updates or deletes the preview Layer of the pull request of the event.
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "events must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxEventSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ev, err := Parse(req.Header, body, r.Secret)
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, ErrIgnored):
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log := log.FromContext(req.Context()).WithValues("layer", r.LayerName(ev.Number), "commit", ev.Commit)
+	if err := r.Apply(req.Context(), ev); err != nil {
+		log.Error(err, "unable to apply pull request event")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Info("applied pull request event", "closed", ev.Closed)
+	w.WriteHeader(http.StatusOK)
+}
+
+// LayerName is the name of the preview Layer of pull request number.
+func (r *Receiver) LayerName(number int) string {
+	prefix := r.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	return fmt.Sprintf("%s-%d", prefix, number)
+}
+
+// Apply creates or updates the preview Layer of an open pull request, or deletes that of a closed one.
+// Deleting the Layer deletes the LayerServices stamped out for it. A Layer of the same name which isn't the
+// pull request's preview layer, without its PullRequestLabel, is left alone.
+func (r *Receiver) Apply(ctx context.Context, ev Event) error {
+	layer := &routelayerv1.Layer{ObjectMeta: metav1.ObjectMeta{Name: r.LayerName(ev.Number)}}
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(layer), layer); client.IgnoreNotFound(err) != nil {
+		return err
+	} else if err == nil && layer.Labels[PullRequestLabel] != strconv.Itoa(ev.Number) {
+		return fmt.Errorf("layer %s is not the preview layer of pull request %d", layer.Name, ev.Number)
+	}
+	if ev.Closed {
+		if layer.ResourceVersion == "" {
+			return nil
+		}
+		// only the preview layer read above, not one created since with the same name.
+		return client.IgnoreNotFound(r.Client.Delete(ctx, layer, client.Preconditions{UID: &layer.UID}))
+	}
+
+	tmpl := &routelayerv1.LayerTemplate{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: r.Template}, tmpl); err != nil {
+		return err
+	}
+	values := map[string]string{"pr": strconv.Itoa(ev.Number), "commit": ev.Commit, "branch": ev.Branch}
+	parameters := map[string]string{}
+	for _, p := range tmpl.Spec.Parameters {
+		if v, ok := values[p.Name]; ok {
+			parameters[p.Name] = v
+		}
+	}
+
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, layer, func() error {
+		if layer.Labels == nil {
+			layer.Labels = map[string]string{}
+		}
+		layer.Labels[PullRequestLabel] = strconv.Itoa(ev.Number)
+		layer.Labels[CommitLabel] = ev.Commit
+		layer.Spec.Parent = r.Parent
+		layer.Spec.Template = &routelayerv1.LayerTemplateRef{Name: r.Template, Parameters: parameters}
+		return nil
+	})
+	return err
+}
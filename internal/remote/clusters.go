@@ -0,0 +1,115 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package remote gives routelayer clients for the remote clusters of a multi-primary mesh, so the routes of
+// the layers reconciled in its own cluster are programmed in every cluster.
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SecretLabel marks the Secrets holding the kubeconfigs of remote clusters. Each key of a Secret's data is the name of
+// a cluster, and its value the kubeconfig - as in the secrets istioctl create-remote-secret writes.
+const SecretLabel = "routelayer.github.com/remote-cluster"
+
+// Clusters are the remote clusters routes are programmed in, besides routelayer's own.
+type Clusters struct {
+	// Reader reads the Secrets
+	Reader client.Reader
+	// Namespace the Secrets are in
+	Namespace string
+	// Scheme of the clients
+	Scheme *runtime.Scheme
+
+	mu      sync.Mutex
+	clients map[string]cached
+}
+
+// cached is the client of a cluster, built from a revision of its kubeconfig.
+type cached struct {
+	version string
+	client  client.Client
+}
+
+// Clients returns a client for each remote cluster, by name. The clients are built again when a kubeconfig changes.
+// A cluster whose kubeconfig can't be used is left out and reported in the error, the others are still returned.
+func (c *Clusters) Clients(ctx context.Context) (map[string]client.Client, error) {
+	list := &corev1.SecretList{}
+	if err := c.Reader.List(ctx, list, client.InNamespace(c.Namespace), client.MatchingLabels{SecretLabel: "true"}); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clients := map[string]cached{}
+	errs := []error{}
+	for i := range list.Items {
+		secret := &list.Items[i]
+		for _, name := range sortedKeys(secret.Data) {
+			version := fmt.Sprintf("%s/%s", secret.UID, secret.ResourceVersion)
+			if existing, ok := c.clients[name]; ok && existing.version == version {
+				clients[name] = existing
+				continue
+			}
+			cl, err := c.client(secret.Data[name])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("cluster %s of Secret %s: %w", name, secret.Name, err))
+				continue
+			}
+			clients[name] = cached{version: version, client: cl}
+		}
+	}
+	c.clients = clients
+
+	result := map[string]client.Client{}
+	for name, cl := range clients {
+		result[name] = cl.client
+	}
+	return result, errors.Join(errs...)
+}
+
+func (c *Clusters) client(kubeconfig []byte) (client.Client, error) {
+	config, err := RESTConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return client.New(config, client.Options{Scheme: c.Scheme})
+}
+
+// RESTConfig returns the config of the cluster a kubeconfig's current context connects to.
+func RESTConfig(kubeconfig []byte) (*rest.Config, error) {
+	return clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func kubeconfig(server string) []byte {
+	return []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: remote
+  cluster:
+    server: ` + server + `
+users:
+- name: routelayer
+  user:
+    token: secret
+contexts:
+- name: remote
+  context:
+    cluster: remote
+    user: routelayer
+current-context: remote
+`)
+}
+
+// secrets is a client.Reader listing the Secrets it holds.
+type secrets struct {
+	client.Reader
+	items []corev1.Secret
+}
+
+func (s *secrets) List(_ context.Context, list client.ObjectList, _ ...client.ListOption) error {
+	list.(*corev1.SecretList).Items = s.items
+	return nil
+}
+
+var _ = Describe("Remote clusters", func() {
+	ctx := context.Background()
+
+	It("should read the server of a kubeconfig", func() {
+		config, err := RESTConfig(kubeconfig("https://west.example.com:6443"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Host).To(Equal("https://west.example.com:6443"))
+		Expect(config.BearerToken).To(Equal("secret"))
+	})
+
+	It("should build a client for each cluster of the Secrets, until their kubeconfig changes", func() {
+		reader := &secrets{items: []corev1.Secret{{
+			ObjectMeta: metav1.ObjectMeta{Name: "remotes", UID: "1", ResourceVersion: "1"},
+			Data: map[string][]byte{
+				"west": kubeconfig("https://west.example.com:6443"),
+				"east": kubeconfig("https://east.example.com:6443"),
+			},
+		}}}
+		c := &Clusters{Reader: reader, Scheme: scheme.Scheme}
+
+		clients, err := c.Clients(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clients).To(HaveLen(2))
+		west := clients["west"]
+
+		clients, err = c.Clients(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clients["west"]).To(BeIdenticalTo(west))
+
+		reader.items[0].ResourceVersion = "2"
+		clients, err = c.Clients(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clients["west"]).NotTo(BeIdenticalTo(west))
+	})
+
+	It("should leave out a cluster whose kubeconfig can't be used", func() {
+		c := &Clusters{Reader: &secrets{items: []corev1.Secret{{
+			ObjectMeta: metav1.ObjectMeta{Name: "remotes"},
+			Data: map[string][]byte{
+				"west": kubeconfig("https://west.example.com:6443"),
+				"east": []byte("not a kubeconfig"),
+			},
+		}}}, Scheme: scheme.Scheme}
+
+		clients, err := c.Clients(ctx)
+		Expect(err).To(MatchError(ContainSubstring("cluster east of Secret remotes")))
+		Expect(clients).To(HaveKey("west"))
+		Expect(clients).NotTo(HaveKey("east"))
+	})
+})
@@ -0,0 +1,172 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+var (
+	AuthorizationPolicyGVK   = schema.GroupVersionKind{Group: "security.istio.io", Version: "v1", Kind: "AuthorizationPolicy"}
+	RequestAuthenticationGVK = schema.GroupVersionKind{Group: "security.istio.io", Version: "v1", Kind: "RequestAuthentication"}
+)
+
+const (
+	// DefaultRootNamespace is the istio root namespace, policies in it apply to the whole mesh.
+	DefaultRootNamespace = "istio-system"
+	// LayerAnnotation records the layer a generated access resource restricts entry to.
+	LayerAnnotation = "routelayer.github.com/layer"
+)
+
+// AccessName is the name of the resources generated to restrict entry to layer.
+func AccessName(layer string) string {
+	return "routelayer-layer-" + layer
+}
+
+// ClusterAccessName is the name of the RequestAuthentications generated in the namespaces a cluster Layer routes,
+// distinct from those of a NamespaceLayer of the same name.
+func ClusterAccessName(layer string) string {
+	return "routelayer-clusterlayer-" + layer
+}
+
+// NewAuthorizationPolicy returns an empty AuthorizationPolicy for the given name and namespace, suitable for a Get.
+func NewAuthorizationPolicy(name, namespace string) *unstructured.Unstructured {
+	return newObject(AuthorizationPolicyGVK, name, namespace)
+}
+
+// NewRequestAuthentication returns an empty RequestAuthentication for the given name and namespace, suitable for a Get.
+func NewRequestAuthentication(name, namespace string) *unstructured.Unstructured {
+	return newObject(RequestAuthenticationGVK, name, namespace)
+}
+
+// AuthorizationPolicy renders a policy denying requests carrying header set to layer, or to one of the layers
+// inheriting its routes, that the access does not allow.
+// It applies to every workload of namespace (every workload of the mesh in the root namespace).
+// A request is denied when it is from none of the principals and namespaces and lacks the JWT, or any of its claims:
+// istio ANDs the conditions of a rule, and denies if any rule matches.
+func AuthorizationPolicy(layer string, inheriting []string, namespace, header string,
+	access *routelayerv1.LayerAccess) *unstructured.Unstructured {
+	ap := newObject(AuthorizationPolicyGVK, AccessName(layer), namespace)
+	setAccessLabels(ap, layer)
+
+	header = strings.ToLower(header)
+	layers := strings2interfaces(append([]string{layer}, inheriting...))
+	rule := func(conditions ...map[string]interface{}) map[string]interface{} {
+		when := []interface{}{
+			map[string]interface{}{"key": fmt.Sprintf("request.headers[%s]", header), "values": layers},
+		}
+		for _, c := range conditions {
+			when = append(when, c)
+		}
+		r := map[string]interface{}{"when": when}
+		source := map[string]interface{}{}
+		if len(access.Principals) > 0 {
+			source["notPrincipals"] = strings2interfaces(access.Principals)
+		}
+		if len(access.Namespaces) > 0 {
+			source["notNamespaces"] = strings2interfaces(access.Namespaces)
+		}
+		if len(source) > 0 {
+			r["from"] = []interface{}{map[string]interface{}{"source": source}}
+		}
+		return r
+	}
+
+	rules := []interface{}{}
+	if access.JWT == nil {
+		rules = append(rules, rule())
+	} else {
+		rules = append(rules, rule(map[string]interface{}{
+			"key": "request.auth.principal", "notValues": []interface{}{access.JWT.Issuer + "/*"},
+		}))
+		claims := make([]string, 0, len(access.JWT.Claims))
+		for claim := range access.JWT.Claims {
+			claims = append(claims, claim)
+		}
+		slices.Sort(claims)
+		for _, claim := range claims {
+			rules = append(rules, rule(map[string]interface{}{
+				"key":       fmt.Sprintf("request.auth.claims[%s]", claim),
+				"notValues": strings2interfaces(access.JWT.Claims[claim]),
+			}))
+		}
+	}
+
+	ap.Object["spec"] = map[string]interface{}{
+		"action": "DENY",
+		"rules":  rules,
+	}
+	setApplied(ap)
+	return ap
+}
+
+// RequestAuthentication renders the JWT validation the access needs, named name, nil if it does not need any.
+// It applies to the workloads of namespace the selector matches, all of them if it is nil.
+// The original token is forwarded so the services in the layer can be entered with it too.
+func RequestAuthentication(name, layer, namespace string, selector map[string]string,
+	access *routelayerv1.LayerAccess) *unstructured.Unstructured {
+	if access == nil || access.JWT == nil {
+		return nil
+	}
+	ra := newObject(RequestAuthenticationGVK, name, namespace)
+	setAccessLabels(ra, layer)
+
+	rule := map[string]interface{}{
+		"issuer":               access.JWT.Issuer,
+		"forwardOriginalToken": true,
+	}
+	if access.JWT.JWKSURI != "" {
+		rule["jwksUri"] = access.JWT.JWKSURI
+	}
+	spec := map[string]interface{}{
+		"jwtRules": []interface{}{rule},
+	}
+	if selector != nil {
+		labels := map[string]interface{}{}
+		for k, v := range selector {
+			labels[k] = v
+		}
+		spec["selector"] = map[string]interface{}{"matchLabels": labels}
+	}
+	ra.Object["spec"] = spec
+	setApplied(ra)
+	return ra
+}
+
+func setAccessLabels(u *unstructured.Unstructured, layer string) {
+	u.SetLabels(map[string]string{
+		ManagedByLabel: ManagedByValue,
+	})
+	u.SetAnnotations(map[string]string{
+		LayerAnnotation: layer,
+	})
+}
+
+func strings2interfaces(values []string) []interface{} {
+	out := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		out = append(out, v)
+	}
+	return out
+}
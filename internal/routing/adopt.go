@@ -0,0 +1,130 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// AdoptedAnnotation records the layer routes added to an adopted VirtualService, as "<section>:<hash>,<hash>,...",
+// so they can be replaced later without touching the routes the VirtualService was written with.
+const AdoptedAnnotation = "routelayer.github.com/adopted-routes"
+
+// AdoptedHostsAnnotation records the hosts added to an adopted VirtualService, the SNI hosts of its TLS layers, as
+// "<host>,<host>,...", so they can be removed later without touching the hosts the VirtualService was written with.
+const AdoptedHostsAnnotation = "routelayer.github.com/adopted-hosts"
+
+// Owned returns true if the resource was generated by routelayer.
+func Owned(u *unstructured.Unstructured) bool {
+	return u.GetLabels()[ManagedByLabel] == ManagedByValue
+}
+
+// Adopted returns true if layer routes have been added to the VirtualService.
+func Adopted(vs *unstructured.Unstructured) bool {
+	_, ok := vs.GetAnnotations()[AdoptedAnnotation]
+	return ok
+}
+
+// RoutesHost returns true if the VirtualService routes mesh traffic for host, a FQDN. The hosts of the VirtualService
+// are interpreted relative to its namespace. VirtualServices bound only to gateways are ignored, they do not
+// route the same traffic as the generated VirtualService.
+func RoutesHost(vs *unstructured.Unstructured, host, domain string) bool {
+	gateways, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "gateways")
+	if len(gateways) > 0 && !slices.Contains(gateways, "mesh") {
+		return false
+	}
+	hosts, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "hosts")
+	return slices.ContainsFunc(hosts, func(h string) bool {
+		return FQDN(h, vs.GetNamespace(), domain) == host
+	})
+}
+
+// Adopt renders the table's layer routes in front of the routes of an existing VirtualService, one not generated
+// by routelayer, as a server-side apply of FieldManager. Layer routes added by a previous Adopt are replaced;
+// all the other routes are preserved, after the layer routes, in their order. The default route is left to the
+// existing routes. A table without routes releases the VirtualService, restoring the routes it was written with.
+func Adopt(existing *unstructured.Unstructured, t Table, header string) *unstructured.Unstructured {
+	vs := newObject(VirtualServiceGVK, existing.GetName(), existing.GetNamespace())
+
+	previousSection, previous := adoptedRoutes(existing)
+	writtenHosts := writtenHosts(existing)
+	spec := map[string]interface{}{
+		"hosts": writtenHosts,
+	}
+	if previousSection != "" {
+		// the section routes were added to is kept, even if the protocol has changed, so it is released.
+		spec[previousSection] = written(existing, previousSection, previous)
+	}
+	vs.Object["spec"] = spec
+
+	section, routes := layerRoutes(t, header)
+	if len(routes) == 0 {
+		return vs
+	}
+	spec[section] = append(routes, written(existing, section, previous)...)
+	allHosts := hosts(t, slices.Clone(writtenHosts))
+	spec["hosts"] = allHosts
+
+	hashes := []string{}
+	for _, r := range routes {
+		hashes = append(hashes, hash(r))
+	}
+	annotations := map[string]string{
+		HostAnnotation:    t.Host,
+		AdoptedAnnotation: section + ":" + strings.Join(hashes, ","),
+	}
+	if added := allHosts[len(writtenHosts):]; len(added) > 0 {
+		names := []string{}
+		for _, h := range added {
+			names = append(names, h.(string))
+		}
+		annotations[AdoptedHostsAnnotation] = strings.Join(names, ",")
+	}
+	vs.SetAnnotations(annotations)
+	return vs
+}
+
+// writtenHosts returns the hosts of the VirtualService which weren't added by a previous Adopt.
+func writtenHosts(vs *unstructured.Unstructured) []interface{} {
+	hosts, _, _ := unstructured.NestedSlice(vs.Object, "spec", "hosts")
+	added := strings.Split(vs.GetAnnotations()[AdoptedHostsAnnotation], ",")
+	return slices.DeleteFunc(hosts, func(h interface{}) bool {
+		s, ok := h.(string)
+		return ok && slices.Contains(added, s)
+	})
+}
+
+// adoptedRoutes returns the section and the hashes of the layer routes recorded on the VirtualService.
+func adoptedRoutes(vs *unstructured.Unstructured) (string, []string) {
+	section, hashes, found := strings.Cut(vs.GetAnnotations()[AdoptedAnnotation], ":")
+	if !found {
+		return "", nil
+	}
+	return section, strings.Split(hashes, ",")
+}
+
+// written returns the routes of the section of the VirtualService which are not layer routes.
+func written(vs *unstructured.Unstructured, section string, layerRoutes []string) []interface{} {
+	routes, _, _ := unstructured.NestedSlice(vs.Object, "spec", section)
+	return slices.DeleteFunc(routes, func(r interface{}) bool {
+		// routes are identified by their content, istio tcp and tls routes have no name.
+		return slices.Contains(layerRoutes, hash(r))
+	})
+}
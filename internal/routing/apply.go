@@ -0,0 +1,73 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// FieldManager is the server-side apply field manager routelayer writes the istio resources with.
+const FieldManager = "routelayer"
+
+// AppliedAnnotation records a hash of the spec routelayer applied to a generated resource,
+// so a spec changed by anyone else can be told apart from one routelayer is about to change.
+const AppliedAnnotation = "routelayer.github.com/applied-spec"
+
+// Drifted returns true if the spec of a generated resource is no longer the one routelayer applied.
+// Resources generated before the spec was recorded have not drifted.
+func Drifted(existing *unstructured.Unstructured) bool {
+	applied, ok := existing.GetAnnotations()[AppliedAnnotation]
+	return ok && applied != hash(existing.Object["spec"])
+}
+
+// Writers returns the field managers, other than routelayer, which own fields of the resource's spec.
+func Writers(existing *unstructured.Unstructured) []string {
+	writers := []string{}
+	for _, entry := range existing.GetManagedFields() {
+		if entry.Manager == FieldManager || entry.FieldsV1 == nil || slices.Contains(writers, entry.Manager) {
+			continue
+		}
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		if _, ok := fields["f:spec"]; ok {
+			writers = append(writers, entry.Manager)
+		}
+	}
+	return writers
+}
+
+func setApplied(u *unstructured.Unstructured) {
+	annotations := u.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[AppliedAnnotation] = hash(u.Object["spec"])
+	u.SetAnnotations(annotations)
+}
+
+// hash identifies a part of a resource by its content.
+func hash(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return fmt.Sprintf("%x", sha256.Sum256(b))[:12]
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var GatewayGVK = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1", Kind: "Gateway"}
+
+// EgressPort is the port requests leave the mesh through an egress gateway on. They are sent on from the gateway
+// to DefaultExternalPort of the host, or of the layer's destination.
+const EgressPort = 80
+
+// EgressName is the name of the Gateway and DestinationRule sending requests for host out through gateway.
+func EgressName(host, gateway string) string {
+	return Name(host) + "-" + gateway
+}
+
+// EgressVirtualServiceName is the name of the VirtualService routing requests for host at its egress gateways.
+func EgressVirtualServiceName(host string) string {
+	return Name(host) + "-egress"
+}
+
+// EgressSubset is the subset of an egress gateway the requests for host are sent to it in.
+// Subset names are DNS labels, a host which is too long for one is shortened with a hash.
+func EgressSubset(host string) string {
+	name := strings.ReplaceAll(host, ".", "-")
+	if len(name) > 63 {
+		sum := sha256.Sum256([]byte(host))
+		name = name[:54] + "-" + hex.EncodeToString(sum[:])[:8]
+	}
+	return name
+}
+
+// EgressGateways returns the egress gateway services the table's requests leave the mesh through, ordered by name.
+func EgressGateways(t Table) []string {
+	gateways := map[string]bool{}
+	if t.Egress != "" {
+		gateways[t.Egress] = true
+	}
+	for _, r := range t.Routes {
+		if r.Egress != "" {
+			gateways[r.Egress] = true
+		}
+	}
+	return sortedKeys(gateways)
+}
+
+// EgressResources renders what sends the table's requests out of the mesh through its egress gateways (see
+// RouteEgress): for each gateway a Gateway, selecting its pods by selectors (the pod labels of each gateway service),
+// and a DestinationRule defining the gateway's subset for the host; and a VirtualService, bound to the Gateways,
+// routing the requests arriving there by their layer header. The sidecars send the requests to the gateways,
+// with the layer header set, from the host's VirtualService. A table with no routes needs none.
+func EgressResources(t Table, header string, selectors map[string]map[string]string) []*unstructured.Unstructured {
+	resources := []*unstructured.Unstructured{}
+	gateways := EgressGateways(t)
+	if len(t.Routes) == 0 || len(gateways) == 0 {
+		return resources
+	}
+
+	bound := []interface{}{}
+	for _, gateway := range gateways {
+		name := EgressName(t.Host, gateway)
+		bound = append(bound, t.Namespace+"/"+name)
+
+		selector := map[string]interface{}{}
+		for k, v := range selectors[gateway] {
+			selector[k] = v
+		}
+		gw := newObject(GatewayGVK, name, t.Namespace)
+		setLabels(gw, t.Host)
+		gw.Object["spec"] = map[string]interface{}{
+			"selector": selector,
+			"servers": []interface{}{
+				map[string]interface{}{
+					"port": map[string]interface{}{
+						"number":   int64(EgressPort),
+						"name":     t.Protocol,
+						"protocol": strings.ToUpper(t.Protocol),
+					},
+					"hosts": []interface{}{t.Host},
+				},
+			},
+		}
+		setApplied(gw)
+
+		dr := newObject(DestinationRuleGVK, name, t.Namespace)
+		setLabels(dr, t.Host)
+		dr.Object["spec"] = map[string]interface{}{
+			"host":     gateway,
+			"exportTo": exportToAll(),
+			"subsets": []interface{}{
+				map[string]interface{}{"name": EgressSubset(t.Host)},
+			},
+		}
+		setApplied(dr)
+		resources = append(resources, gw, dr)
+	}
+
+	header = strings.ToLower(header)
+	http := []interface{}{}
+	for _, r := range t.Routes {
+		if r.Egress == "" {
+			continue
+		}
+		route := map[string]interface{}{
+			"name": r.Layer,
+			"match": []interface{}{
+				map[string]interface{}{
+					"headers": map[string]interface{}{
+						header: map[string]interface{}{"exact": r.Layer},
+					},
+				},
+			},
+			"route": []interface{}{
+				map[string]interface{}{"destination": egressedDestination(r.Destination)},
+			},
+		}
+		if r.Destination != t.Host {
+			route["rewrite"] = map[string]interface{}{"authority": r.Destination}
+		}
+		http = append(http, route)
+	}
+	http = append(http, map[string]interface{}{
+		"name": "default",
+		"route": []interface{}{
+			map[string]interface{}{"destination": egressedDestination(t.Host)},
+		},
+	})
+	vs := newObject(VirtualServiceGVK, EgressVirtualServiceName(t.Host), t.Namespace)
+	setLabels(vs, t.Host)
+	vs.Object["spec"] = map[string]interface{}{
+		"hosts":    []interface{}{t.Host},
+		"gateways": bound,
+		"exportTo": exportToAll(),
+		"http":     http,
+	}
+	setApplied(vs)
+	return append(resources, vs)
+}
+
+// layerDestination is where the requests in route's layer, on port, are sent: to its destination or, when they leave
+// the mesh through an egress gateway, to the gateway.
+func layerDestination(t Table, r Route, port uint32) map[string]interface{} {
+	if r.Egress != "" {
+		return gatewayDestination(t, r.Egress)
+	}
+	return destination(r, port)
+}
+
+// hostDestination is where the requests in no layer are sent: to the host itself or, when they leave the mesh
+// through an egress gateway, to the gateway.
+func hostDestination(t Table) map[string]interface{} {
+	if t.Egress != "" {
+		return gatewayDestination(t, t.Egress)
+	}
+	return map[string]interface{}{"host": t.Host}
+}
+
+func gatewayDestination(t Table, gateway string) map[string]interface{} {
+	return map[string]interface{}{
+		"host":   gateway,
+		"subset": EgressSubset(t.Host),
+		"port":   map[string]interface{}{"number": int64(EgressPort)},
+	}
+}
+
+// egressedDestination is the external host requests leaving an egress gateway are sent to.
+func egressedDestination(host string) map[string]interface{} {
+	return map[string]interface{}{
+		"host": host,
+		"port": map[string]interface{}{"number": int64(DefaultExternalPort)},
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+const (
+	// NotEnrolled is the enrollment cookie value, and layer header, of a user kept out of a layer. No layer can be
+	// named it.
+	NotEnrolled = "-"
+	// EnrollmentCookieMaxAge is how long, in seconds, an enrollment cookie keeps a user in or out of a layer.
+	EnrollmentCookieMaxAge = 30 * 24 * 60 * 60
+)
+
+// EnrollmentCookie is the name of the cookie keeping users in or out of layer.
+func EnrollmentCookie(layer string, e *routelayerv1.LayerEnrollment) string {
+	if e.Cookie != "" {
+		return e.Cookie
+	}
+	return "routelayer-" + layer
+}
+
+// enrollmentRoutes returns the routes putting users into the layers which enroll them, they come after the header and
+// entry routes so those always win. For each layer, in turn:
+//
+//   - users whose enrollment cookie is set to the layer stay in it,
+//   - users whose hash key falls in the layer's percentage are enrolled, and given the cookie,
+//   - users with neither the cookie nor a hash key are enrolled at random, and given the cookie set to the layer,
+//     or to NotEnrolled if they weren't. A user kept out of one layer may be enrolled in another by a later request.
+//     Those not enrolled have the layer header set to NotEnrolled, and requests with a layer header aren't drawn,
+//     so the calls between services a request makes, which carry the header but no cookies, aren't drawn again.
+func enrollmentRoutes(t Table, header string) []interface{} {
+	enrolling := []Route{}
+	for _, r := range t.Routes {
+		if r.Enrollment != nil {
+			enrolling = append(enrolling, r)
+		}
+	}
+
+	http := []interface{}{}
+	for _, r := range enrolling {
+		cookie := EnrollmentCookie(r.Layer, r.Enrollment)
+		for _, port := range ports(r) {
+			http = append(http, httpRoute(routeName(r.Layer+"-enrolled", port), t, r, port, header, []interface{}{
+				map[string]interface{}{
+					"headers": map[string]interface{}{
+						"cookie": map[string]interface{}{"regex": CookieRegex(cookie, r.Layer)},
+					},
+				},
+			}))
+		}
+	}
+	for _, r := range enrolling {
+		match := cohortMatch(r.Enrollment)
+		if match == nil {
+			continue
+		}
+		for _, port := range ports(r) {
+			route := httpRoute(routeName(r.Layer+"-cohort", port), t, r, port, header, []interface{}{match})
+			route["headers"].(map[string]interface{})["response"] = setCookie(EnrollmentCookie(r.Layer, r.Enrollment), r.Layer)
+			http = append(http, route)
+		}
+	}
+	for _, r := range enrolling {
+		if r.Enrollment.Percentage <= 0 {
+			continue
+		}
+		for _, port := range ports(r) {
+			http = append(http, sampleRoute(t, r, port, header))
+		}
+	}
+	return http
+}
+
+// sampleRoute enrolls a percentage of the users with neither the layer's enrollment cookie nor a hash key.
+func sampleRoute(t Table, r Route, port uint32, header string) map[string]interface{} {
+	e := r.Enrollment
+	cookie := EnrollmentCookie(r.Layer, e)
+	cookies := regexp.QuoteMeta(cookie)
+	if e.HashCookie != "" {
+		cookies = "(" + cookies + "|" + regexp.QuoteMeta(e.HashCookie) + ")"
+	}
+	without := map[string]interface{}{
+		"cookie": map[string]interface{}{"regex": fmt.Sprintf(`^(.*;\s*)?%s=.*$`, cookies)},
+		header:   map[string]interface{}{"regex": ".*"},
+	}
+	if e.HashHeader != "" {
+		without[strings.ToLower(e.HashHeader)] = map[string]interface{}{"regex": ".*"}
+	}
+	match := map[string]interface{}{"withoutHeaders": without}
+	if port != 0 {
+		match["port"] = int64(port)
+	}
+
+	route := []interface{}{
+		map[string]interface{}{
+			"destination": layerDestination(t, r, port),
+			"weight":      int64(e.Percentage),
+			"headers": map[string]interface{}{
+				"request":  map[string]interface{}{"set": map[string]interface{}{header: r.Layer}},
+				"response": setCookie(cookie, r.Layer),
+			},
+		},
+	}
+	if e.Percentage < 100 {
+		route = append(route, map[string]interface{}{
+			"destination": hostDestination(t),
+			"weight":      int64(100 - e.Percentage),
+			"headers": map[string]interface{}{
+				"request":  map[string]interface{}{"set": map[string]interface{}{header: NotEnrolled}},
+				"response": setCookie(cookie, NotEnrolled),
+			},
+		})
+	}
+	sample := map[string]interface{}{
+		"name":  routeName(r.Layer+"-sample", port),
+		"match": []interface{}{match},
+		"route": route,
+	}
+	// as in httpRoute, unless users not sampled go on to a host outside the cluster, which needs its own name.
+	if r.External && r.Egress == "" && (e.Percentage >= 100 || !t.External) {
+		sample["rewrite"] = map[string]interface{}{"authority": r.Destination}
+	}
+	return sample
+}
+
+// cohortMatch returns the HTTPMatchRequest for the users whose hash key falls in the enrollment's percentage,
+// nil if it has no hash key or the percentage is too small to enroll anyone.
+func cohortMatch(e *routelayerv1.LayerEnrollment) map[string]interface{} {
+	cohort := CohortRegex(e.Percentage)
+	switch {
+	case cohort == "":
+		return nil
+	case e.HashHeader != "":
+		return map[string]interface{}{
+			"headers": map[string]interface{}{
+				strings.ToLower(e.HashHeader): map[string]interface{}{"regex": "^.*" + cohort + "$"},
+			},
+		}
+	case e.HashCookie != "":
+		return map[string]interface{}{
+			"headers": map[string]interface{}{
+				"cookie": map[string]interface{}{
+					"regex": fmt.Sprintf(`^(.*;\s*)?%s=[^;]*%s(;.*)?$`, regexp.QuoteMeta(e.HashCookie), cohort),
+				},
+			},
+		}
+	}
+	return nil
+}
+
+// CohortRegex matches the last two hex digits of the hash keys in the first percentage of the 256 cohorts they
+// divide users into, "" if percentage is too small to include any.
+func CohortRegex(percentage int32) string {
+	const hex = "0123456789abcdef"
+	class := func(chars string) string {
+		return "[" + chars + strings.ToUpper(strings.TrimLeft(chars, "0123456789")) + "]"
+	}
+	n := (int(percentage)*256 + 50) / 100
+	cohorts := []string{}
+	if hi := n / 16; hi > 0 {
+		cohorts = append(cohorts, class(hex[:hi])+class(hex))
+	}
+	if lo := n % 16; lo > 0 {
+		cohorts = append(cohorts, class(hex[n/16:n/16+1])+class(hex[:lo]))
+	}
+	if len(cohorts) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(cohorts, "|") + ")"
+}
+
+// setCookie returns the response header operations giving a user the cookie set to value.
+func setCookie(cookie, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"add": map[string]interface{}{
+			"set-cookie": fmt.Sprintf("%s=%s; Path=/; Max-Age=%d", cookie, value, EnrollmentCookieMaxAge),
+		},
+	}
+}
@@ -0,0 +1,402 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+var EnvoyFilterGVK = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1alpha3", Kind: "EnvoyFilter"}
+
+// DefaultIngressSelector selects the istio ingress gateway installed by default.
+var DefaultIngressSelector = map[string]string{"istio": "ingressgateway"}
+
+// IngressName is the name of the resources generated for an IngressPolicy.
+func IngressName(policy string) string {
+	return "routelayer-ingress-" + policy
+}
+
+// NewEnvoyFilter returns an empty EnvoyFilter for the given name and namespace, suitable for a Get.
+func NewEnvoyFilter(name, namespace string) *unstructured.Unstructured {
+	return newObject(EnvoyFilterGVK, name, namespace)
+}
+
+// IngressEntry is how requests select layers other than by the layer header, which the ingress filter removes from
+// requests no rule allows too.
+type IngressEntry struct {
+	// Cookies - the entry and enrollment cookies of the layers.
+	Cookies []string
+	// QueryParams - the entry query parameters of the layers.
+	QueryParams []string
+	// Subdomains - the layers entered by a subdomain of their hosts.
+	Subdomains []string
+}
+
+// Add adds the ways requests select layer, as its spec has them.
+func (e *IngressEntry) Add(layer string, spec routelayerv1.LayerSpec) {
+	if entry := spec.Entry; entry != nil {
+		if entry.Cookie != "" {
+			e.Cookies = append(e.Cookies, entry.Cookie)
+		}
+		if entry.QueryParam != "" {
+			e.QueryParams = append(e.QueryParams, entry.QueryParam)
+		}
+		if entry.Subdomain {
+			e.Subdomains = append(e.Subdomains, layer)
+		}
+	}
+	if spec.Enrollment != nil {
+		e.Cookies = append(e.Cookies, EnrollmentCookie(layer, spec.Enrollment))
+	}
+}
+
+// IPRange is an inclusive range of IPv4 addresses, as numbers.
+type IPRange [2]uint32
+
+// ParseIPBlock parses an IPv4 address or CIDR range.
+func ParseIPBlock(block string) (IPRange, error) {
+	if !strings.Contains(block, "/") {
+		block += "/32"
+	}
+	prefix, err := netip.ParsePrefix(block)
+	if err != nil {
+		return IPRange{}, err
+	}
+	if !prefix.Addr().Is4() {
+		return IPRange{}, fmt.Errorf("%s is not an IPv4 range", block)
+	}
+	start := binary.BigEndian.Uint32(prefix.Masked().Addr().AsSlice())
+	return IPRange{start, start | ^uint32(0)>>prefix.Bits()}, nil
+}
+
+// IngressEnvoyFilter renders a lua filter for the ingress gateways, in the root namespace, which removes header
+// from requests no rule of the policy allows, with the cookies and query parameters of the entry. Those requests
+// for a subdomain of the entry are denied, as the subdomain can't be removed without changing the host.
+// It runs just before the router, after istio has validated any JWT, so the claims of a valid JWT are in the
+// jwt_authn metadata under its issuer.
+func IngressEnvoyFilter(policy *routelayerv1.IngressPolicy, namespace, header string, entry IngressEntry) (*unstructured.Unstructured, error) {
+	script, err := ingressScript(policy.Spec.Allow, strings.ToLower(header), entry)
+	if err != nil {
+		return nil, err
+	}
+	ef := newObject(EnvoyFilterGVK, IngressName(policy.Name), namespace)
+	ef.SetLabels(map[string]string{ManagedByLabel: ManagedByValue})
+
+	ef.Object["spec"] = map[string]interface{}{
+		"workloadSelector": map[string]interface{}{"labels": ingressSelector(policy)},
+		"configPatches": []interface{}{
+			map[string]interface{}{
+				"applyTo": "HTTP_FILTER",
+				"match": map[string]interface{}{
+					"context": "GATEWAY",
+					"listener": map[string]interface{}{
+						"filterChain": map[string]interface{}{
+							"filter": map[string]interface{}{
+								"name":      "envoy.filters.network.http_connection_manager",
+								"subFilter": map[string]interface{}{"name": "envoy.filters.http.router"},
+							},
+						},
+					},
+				},
+				"patch": map[string]interface{}{
+					"operation": "INSERT_BEFORE",
+					"value": map[string]interface{}{
+						"name": "routelayer.strip-layer-header",
+						"typed_config": map[string]interface{}{
+							"@type":      "type.googleapis.com/envoy.extensions.filters.http.lua.v3.Lua",
+							"inlineCode": script,
+						},
+					},
+				},
+			},
+		},
+	}
+	setApplied(ef)
+	return ef, nil
+}
+
+// IngressRequestAuthentication renders the validation, at the ingress gateways, of the JWTs the policy's rules
+// need, nil if they need none.
+func IngressRequestAuthentication(policy *routelayerv1.IngressPolicy, namespace string) *unstructured.Unstructured {
+	rules := []interface{}{}
+	issuers := []string{}
+	for _, allow := range policy.Spec.Allow {
+		if allow.JWT == nil || slices.Contains(issuers, allow.JWT.Issuer) {
+			continue
+		}
+		issuers = append(issuers, allow.JWT.Issuer)
+		rule := map[string]interface{}{
+			"issuer":               allow.JWT.Issuer,
+			"forwardOriginalToken": true,
+		}
+		if allow.JWT.JWKSURI != "" {
+			rule["jwksUri"] = allow.JWT.JWKSURI
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	ra := newObject(RequestAuthenticationGVK, IngressName(policy.Name), namespace)
+	ra.SetLabels(map[string]string{ManagedByLabel: ManagedByValue})
+	ra.Object["spec"] = map[string]interface{}{
+		"selector": map[string]interface{}{"matchLabels": ingressSelector(policy)},
+		"jwtRules": rules,
+	}
+	setApplied(ra)
+	return ra
+}
+
+func ingressSelector(policy *routelayerv1.IngressPolicy) map[string]interface{} {
+	selector := policy.Spec.Selector
+	if len(selector) == 0 {
+		selector = DefaultIngressSelector
+	}
+	labels := map[string]interface{}{}
+	for k, v := range selector {
+		labels[k] = v
+	}
+	return labels
+}
+
+// ingressScript renders the rules and the entry as lua tables ahead of the code matching them.
+func ingressScript(allow []routelayerv1.IngressAllowRule, header string, entry IngressEntry) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "local header = %s\n", luaQuote(header))
+	for _, set := range []struct {
+		name   string
+		values []string
+	}{
+		{"cookies", entry.Cookies},
+		{"params", entry.QueryParams},
+		{"subdomains", entry.Subdomains},
+	} {
+		values := slices.Clone(set.values)
+		if set.name == "subdomains" {
+			for i := range values {
+				values[i] = strings.ToLower(values[i])
+			}
+		}
+		slices.Sort(values)
+		fmt.Fprintf(&b, "local %s = {", set.name)
+		for _, v := range slices.Compact(values) {
+			fmt.Fprintf(&b, "[%s] = true, ", luaQuote(v))
+		}
+		b.WriteString("}\n")
+	}
+	b.WriteString("local rules = {\n")
+	for _, rule := range allow {
+		b.WriteString("  {ranges = {")
+		for _, block := range rule.IPBlocks {
+			r, err := ParseIPBlock(block)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "{%d, %d}, ", r[0], r[1])
+		}
+		b.WriteString("}")
+		if rule.JWT != nil {
+			fmt.Fprintf(&b, ", issuer = %s, claims = {", luaQuote(rule.JWT.Issuer))
+			claims := make([]string, 0, len(rule.JWT.Claims))
+			for claim := range rule.JWT.Claims {
+				claims = append(claims, claim)
+			}
+			slices.Sort(claims)
+			for _, claim := range claims {
+				fmt.Fprintf(&b, "[%s] = {", luaQuote(claim))
+				for _, v := range rule.JWT.Claims[claim] {
+					fmt.Fprintf(&b, "%s, ", luaQuote(v))
+				}
+				b.WriteString("}, ")
+			}
+			b.WriteString("}")
+		}
+		b.WriteString("},\n")
+	}
+	b.WriteString("}\n")
+	b.WriteString(ingressLua)
+	return b.String(), nil
+}
+
+// luaQuote quotes s as a lua string literal, escaping anything but printable ASCII as decimal.
+func luaQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+const ingressLua = `
+local function address(handle)
+  local a, b, c, d = string.match(handle:streamInfo():downstreamRemoteAddress() or "", "^(%d+)%.(%d+)%.(%d+)%.(%d+)")
+  if a == nil then
+    return nil
+  end
+  return ((tonumber(a) * 256 + tonumber(b)) * 256 + tonumber(c)) * 256 + tonumber(d)
+end
+
+local function fromRanges(ip, ranges)
+  if #ranges == 0 then
+    return true
+  end
+  if ip == nil then
+    return false
+  end
+  for _, r in ipairs(ranges) do
+    if ip >= r[1] and ip <= r[2] then
+      return true
+    end
+  end
+  return false
+end
+
+local function hasValue(claim, values)
+  if type(claim) ~= "table" then
+    claim = {claim}
+  end
+  for _, c in ipairs(claim) do
+    for _, v in ipairs(values) do
+      if tostring(c) == v then
+        return true
+      end
+    end
+  end
+  return false
+end
+
+local function hasJWT(handle, rule)
+  if rule.issuer == nil then
+    return true
+  end
+  local metadata = handle:streamInfo():dynamicMetadata():get("envoy.filters.http.jwt_authn")
+  local payload = metadata and metadata[rule.issuer]
+  if payload == nil then
+    return false
+  end
+  for name, values in pairs(rule.claims) do
+    if not hasValue(payload[name], values) then
+      return false
+    end
+  end
+  return true
+end
+
+local function allowed(handle)
+  local ip = address(handle)
+  for _, rule in ipairs(rules) do
+    if fromRanges(ip, rule.ranges) and hasJWT(handle, rule) then
+      return true
+    end
+  end
+  return false
+end
+
+local function decode(s)
+  return (string.gsub(s, "%%(%x%x)", function(h) return string.char(tonumber(h, 16)) end))
+end
+
+-- withoutCookies returns the cookie header without the entry cookies, and whether it had any.
+local function withoutCookies(value)
+  if value == nil then
+    return nil, false
+  end
+  local kept, found = {}, false
+  for part in string.gmatch(value, "[^;,]+") do
+    part = string.match(part, "^%s*(.-)%s*$")
+    if cookies[string.match(part, "^[^=]*")] then
+      found = true
+    elseif part ~= "" then
+      table.insert(kept, part)
+    end
+  end
+  return table.concat(kept, "; "), found
+end
+
+-- withoutParams returns the path without the entry query parameters, and whether it had any.
+local function withoutParams(path)
+  local base, query = string.match(path or "", "^([^?]*)%?(.*)$")
+  if base == nil then
+    return path, false
+  end
+  local kept, found = {}, false
+  for part in string.gmatch(query, "[^&]+") do
+    if params[decode(string.match(part, "^[^=]*"))] then
+      found = true
+    else
+      table.insert(kept, part)
+    end
+  end
+  if #kept == 0 then
+    return base, found
+  end
+  return base .. "?" .. table.concat(kept, "&"), found
+end
+
+local function fromSubdomain(authority)
+  local label = string.match(string.lower(authority or ""), "^([^.]+)%.")
+  return label ~= nil and subdomains[label] == true
+end
+
+function envoy_on_request(handle)
+  local headers = handle:headers()
+  local cookie, hasCookie = withoutCookies(headers:get("cookie"))
+  local path, hasParam = withoutParams(headers:get(":path"))
+  local hasSubdomain = fromSubdomain(headers:get(":authority"))
+  if headers:get(header) == nil and not hasCookie and not hasParam and not hasSubdomain then
+    return
+  end
+  if allowed(handle) then
+    return
+  end
+  if hasSubdomain then
+    handle:respond({[":status"] = "403"}, "layer subdomains are not allowed")
+    return
+  end
+  headers:remove(header)
+  if hasCookie then
+    if cookie == "" then
+      headers:remove("cookie")
+    else
+      headers:replace("cookie", cookie)
+    end
+  end
+  if hasParam then
+    headers:replace(":path", path)
+  end
+end
+`
@@ -0,0 +1,364 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+// The istio resources are built as unstructured objects, this avoids taking a dependency on the istio client libraries.
+var (
+	VirtualServiceGVK  = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1", Kind: "VirtualService"}
+	DestinationRuleGVK = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1", Kind: "DestinationRule"}
+)
+
+const (
+	// ManagedByLabel is set on every generated resource.
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedByValue = "routelayer"
+	// HostAnnotation records the host a generated resource routes for.
+	// It is an annotation as a FQDN can be longer than a label value allows.
+	HostAnnotation = "routelayer.github.com/host"
+)
+
+// Name is the name of the resources generated for host.
+func Name(host string) string {
+	return "routelayer-" + host
+}
+
+// NewVirtualService returns an empty VirtualService for the given name and namespace, suitable for a Get.
+func NewVirtualService(name, namespace string) *unstructured.Unstructured {
+	return newObject(VirtualServiceGVK, name, namespace)
+}
+
+// NewDestinationRule returns an empty DestinationRule for the given name and namespace, suitable for a Get.
+func NewDestinationRule(name, namespace string) *unstructured.Unstructured {
+	return newObject(DestinationRuleGVK, name, namespace)
+}
+
+// VirtualService renders the table into a VirtualService for the host.
+// Requests are matched to layers by header, then by any entry matches (cookie, query param, subdomain).
+// Every matched request has header set to its layer so the layer context propagates from a single header.
+// Requests which match no layer are routed to the host itself.
+// Hosts speaking tcp or tls are routed by port or SNI instead, see tcpRoutes and tlsRoutes.
+func VirtualService(t Table, header string) *unstructured.Unstructured {
+	vs := newObject(VirtualServiceGVK, Name(t.Host), t.Namespace)
+	setLabels(vs, t.Host)
+
+	section, routes := layerRoutes(t, header)
+	vs.Object["spec"] = map[string]interface{}{
+		"hosts":    hosts(t, []interface{}{t.Host}),
+		"exportTo": exportToAll(),
+		section:    append(routes, defaultRoute(t)),
+	}
+	setApplied(vs)
+	return vs
+}
+
+// layerRoutes returns the section of the VirtualService the table's protocol is routed in, and the layer routes.
+func layerRoutes(t Table, header string) (string, []interface{}) {
+	switch t.Protocol {
+	case routelayerv1.ProtocolTCP:
+		return "tcp", tcpRoutes(t)
+	case routelayerv1.ProtocolTLS:
+		return "tls", tlsRoutes(t)
+	}
+	return "http", httpRoutes(t, header)
+}
+
+// defaultRoute sends everything which matches no layer to the host itself.
+func defaultRoute(t Table) map[string]interface{} {
+	route := map[string]interface{}{
+		"route": []interface{}{
+			map[string]interface{}{"destination": hostDestination(t)},
+		},
+	}
+	switch t.Protocol {
+	case routelayerv1.ProtocolTLS:
+		route["match"] = []interface{}{
+			map[string]interface{}{"sniHosts": []interface{}{t.Host}},
+		}
+	case routelayerv1.ProtocolTCP:
+		// istio tcp routes have no name
+	default:
+		route["name"] = "default"
+	}
+	return route
+}
+
+// hosts adds the hosts the table needs to those given: istio requires every SNI host matched
+// to also be a host of the VirtualService.
+func hosts(t Table, hosts []interface{}) []interface{} {
+	if t.Protocol != routelayerv1.ProtocolTLS {
+		return hosts
+	}
+	for _, r := range t.Routes {
+		if sni := SNIHost(r.Layer, t.Host); !slices.Contains(hosts, interface{}(sni)) {
+			hosts = append(hosts, sni)
+		}
+	}
+	return hosts
+}
+
+// SNIHost is the server name a TLS client uses to enter layer for host.
+func SNIHost(layer, host string) string {
+	return layer + "." + host
+}
+
+func httpRoutes(t Table, header string) []interface{} {
+	// istio only matches lower case header names - which is also how gRPC metadata arrives over HTTP/2.
+	header = strings.ToLower(header)
+
+	http := []interface{}{}
+	for _, r := range t.Routes {
+		for _, port := range ports(r) {
+			http = append(http, httpRoute(routeName(r.Layer, port), t, r, port, header, []interface{}{
+				map[string]interface{}{
+					"headers": map[string]interface{}{
+						header: map[string]interface{}{"exact": r.Layer},
+					},
+				},
+			}))
+		}
+	}
+	// entry matches come after all the header matches so an explicit header always wins.
+	for _, r := range t.Routes {
+		for _, port := range ports(r) {
+			if match := entryMatches(r); len(match) > 0 {
+				http = append(http, httpRoute(routeName(r.Layer+"-entry", port), t, r, port, header, match))
+			}
+		}
+	}
+	return append(http, enrollmentRoutes(t, header)...)
+}
+
+// tcpRoutes routes connections to a layer's ports of the host to the layer, one route per port,
+// each sent to the same port of the destination as the http routes are.
+func tcpRoutes(t Table) []interface{} {
+	tcp := []interface{}{}
+	for _, r := range t.Routes {
+		for _, port := range r.Ports {
+			tcp = append(tcp, map[string]interface{}{
+				"match": []interface{}{
+					map[string]interface{}{"port": int64(port)},
+				},
+				"route": []interface{}{
+					map[string]interface{}{"destination": destination(r, port)},
+				},
+			})
+		}
+	}
+	return tcp
+}
+
+// tlsRoutes routes TLS connections (passed through, not terminated) to a layer by their SNI.
+func tlsRoutes(t Table) []interface{} {
+	tls := []interface{}{}
+	for _, r := range t.Routes {
+		for _, port := range ports(r) {
+			match := map[string]interface{}{
+				"sniHosts": []interface{}{SNIHost(r.Layer, t.Host)},
+			}
+			if port != 0 {
+				match["port"] = int64(port)
+			}
+			tls = append(tls, map[string]interface{}{
+				"match": []interface{}{match},
+				"route": []interface{}{
+					map[string]interface{}{"destination": destination(r, port)},
+				},
+			})
+		}
+	}
+	return tls
+}
+
+// DestinationRule renders the subsets and connection settings of the table,
+// it returns nil when the table needs neither.
+func DestinationRule(t Table) *unstructured.Unstructured {
+	policy := trafficPolicy(t.Protocol)
+	if len(t.Subsets) == 0 && policy == nil {
+		return nil
+	}
+	dr := newObject(DestinationRuleGVK, Name(t.Host), t.Namespace)
+	setLabels(dr, t.Host)
+
+	subsets := []interface{}{}
+	for _, s := range t.Subsets {
+		labels := map[string]interface{}{}
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		subsets = append(subsets, map[string]interface{}{
+			"name":   s.Name,
+			"labels": labels,
+		})
+	}
+	spec := map[string]interface{}{
+		"host":     t.Host,
+		"exportTo": exportToAll(),
+	}
+	if len(subsets) > 0 {
+		spec["subsets"] = subsets
+	}
+	if policy != nil {
+		spec["trafficPolicy"] = policy
+	}
+	dr.Object["spec"] = spec
+	setApplied(dr)
+	return dr
+}
+
+// trafficPolicy returns the connection settings for the protocol, nil if the istio defaults suffice.
+// HTTP/2 connections are multiplexed, so are upgraded and kept open. gRPC clients hold a connection
+// per backend, so requests are balanced to the least loaded rather than round robin.
+func trafficPolicy(protocol string) map[string]interface{} {
+	switch protocol {
+	case routelayerv1.ProtocolHTTP2:
+		return map[string]interface{}{
+			"connectionPool": map[string]interface{}{
+				"http": map[string]interface{}{"h2UpgradePolicy": "UPGRADE"},
+			},
+		}
+	case routelayerv1.ProtocolGRPC:
+		return map[string]interface{}{
+			"connectionPool": map[string]interface{}{
+				"http": map[string]interface{}{"h2UpgradePolicy": "UPGRADE"},
+			},
+			"loadBalancer": map[string]interface{}{"simple": "LEAST_REQUEST"},
+		}
+	}
+	return nil
+}
+
+func httpRoute(name string, t Table, r Route, port uint32, header string, match []interface{}) map[string]interface{} {
+	if port != 0 {
+		for _, m := range match {
+			m.(map[string]interface{})["port"] = int64(port)
+		}
+	}
+	route := map[string]interface{}{
+		"name":  name,
+		"match": match,
+		"route": []interface{}{
+			map[string]interface{}{"destination": layerDestination(t, r, port)},
+		},
+		"headers": map[string]interface{}{
+			"request": map[string]interface{}{
+				"set": map[string]interface{}{header: r.Layer},
+			},
+		},
+	}
+	if r.External && r.Egress == "" {
+		// a server outside the cluster only answers to its own name.
+		route["rewrite"] = map[string]interface{}{"authority": r.Destination}
+	}
+	return route
+}
+
+// ports returns the ports a route is rendered for - a route for all ports is rendered once, as port 0.
+func ports(r Route) []uint32 {
+	if len(r.Ports) == 0 {
+		return []uint32{0}
+	}
+	return r.Ports
+}
+
+func routeName(name string, port uint32) string {
+	if port == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", name, port)
+}
+
+// destination of the route, sent to port of the destination unless it is 0.
+func destination(r Route, port uint32) map[string]interface{} {
+	destination := map[string]interface{}{"host": r.Destination}
+	if r.Subset != "" {
+		destination["subset"] = r.Subset
+	}
+	if port != 0 {
+		destination["port"] = map[string]interface{}{"number": int64(port)}
+	}
+	return destination
+}
+
+// entryMatches returns the istio HTTPMatchRequests for the entry options of the route's layer.
+// Each is an alternative (istio ORs the match list).
+func entryMatches(r Route) []interface{} {
+	match := []interface{}{}
+	if r.Entry == nil {
+		return match
+	}
+	if r.Entry.Cookie != "" {
+		match = append(match, map[string]interface{}{
+			"headers": map[string]interface{}{
+				"cookie": map[string]interface{}{"regex": CookieRegex(r.Entry.Cookie, r.Layer)},
+			},
+		})
+	}
+	if r.Entry.QueryParam != "" {
+		match = append(match, map[string]interface{}{
+			"queryParams": map[string]interface{}{
+				r.Entry.QueryParam: map[string]interface{}{"exact": r.Layer},
+			},
+		})
+	}
+	if r.Entry.Subdomain {
+		match = append(match, map[string]interface{}{
+			"authority": map[string]interface{}{"prefix": r.Layer + "."},
+		})
+	}
+	return match
+}
+
+// CookieRegex matches a Cookie header containing the cookie name set to value.
+// Istio regexes must match the whole header value.
+func CookieRegex(name, value string) string {
+	return fmt.Sprintf(`^(.*;\s*)?%s=%s(;.*)?$`, regexp.QuoteMeta(name), regexp.QuoteMeta(value))
+}
+
+// exportToAll makes a generated resource visible to every namespace, so routing behaves the same
+// wherever the client is - not only in the namespace the resource is generated in.
+func exportToAll() []interface{} {
+	return []interface{}{"*"}
+}
+
+func newObject(gvk schema.GroupVersionKind, name, namespace string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	u.SetName(name)
+	u.SetNamespace(namespace)
+	return u
+}
+
+func setLabels(u *unstructured.Unstructured, host string) {
+	u.SetLabels(map[string]string{
+		ManagedByLabel: ManagedByValue,
+	})
+	u.SetAnnotations(map[string]string{
+		HostAnnotation: host,
+	})
+}
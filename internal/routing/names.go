@@ -0,0 +1,88 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"strings"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+// DefaultClusterDomain is the DNS domain of the cluster when none is configured.
+const DefaultClusterDomain = "cluster.local"
+
+// FQDN normalizes a host written relative to namespace into a fully qualified name, the same way
+// kubernetes DNS (and istio) interprets it:
+//
+//	http-echo                          -> http-echo.<namespace>.svc.<domain>
+//	http-echo.demo                     -> http-echo.demo.svc.<domain>
+//	http-echo.demo.svc                 -> http-echo.demo.svc.<domain>
+//	http-echo.demo.svc.<domain>        -> unchanged
+//	api.example.com                    -> unchanged (not a cluster service)
+//	httpbin.org.                       -> httpbin.org (a trailing dot marks a name absolute, as in DNS)
+func FQDN(host, namespace, domain string) string {
+	host, absolute := strings.CutSuffix(strings.ToLower(host), ".")
+	suffix := ".svc." + domain
+	switch parts := strings.Split(host, "."); {
+	case absolute, strings.HasSuffix(host, suffix):
+		return host
+	case len(parts) == 1:
+		return host + "." + namespace + suffix
+	case len(parts) == 2:
+		return host + suffix
+	case len(parts) == 3 && parts[2] == "svc":
+		return host + "." + domain
+	}
+	return host
+}
+
+// Absolute returns the FQDN of host written so that it reads the same relative to any namespace: a name outside the
+// cluster keeps a trailing dot, as it could otherwise be taken for <service>.<namespace>.
+func Absolute(host, namespace, domain string) string {
+	fqdn := FQDN(host, namespace, domain)
+	if _, ok := HostNamespace(fqdn, domain); ok {
+		return fqdn
+	}
+	return fqdn + "."
+}
+
+// HostNamespace returns the namespace of the cluster service a FQDN names, false if it is not a cluster service.
+func HostNamespace(fqdn, domain string) (string, bool) {
+	name, found := strings.CutSuffix(fqdn, ".svc."+domain)
+	if !found {
+		return "", false
+	}
+	parts := strings.Split(name, ".")
+	if len(parts) != 2 {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// Normalize returns a copy of the LayerService with its host, destination and egress gateway as FQDNs, relative to
+// its namespace.
+func Normalize(ls routelayerv1.LayerService, domain string) routelayerv1.LayerService {
+	n := *ls.DeepCopy()
+	n.Spec.Host = FQDN(n.Spec.Host, n.Namespace, domain)
+	if n.Spec.Destination != "" {
+		n.Spec.Destination = FQDN(n.Spec.Destination, n.Namespace, domain)
+	}
+	if n.Spec.EgressGateway != "" {
+		n.Spec.EgressGateway = FQDN(n.Spec.EgressGateway, n.Namespace, domain)
+	}
+	return n
+}
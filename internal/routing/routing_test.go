@@ -0,0 +1,1023 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"fmt"
+	"regexp"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+const (
+	host      = "http-echo"
+	namespace = "routing-demo"
+)
+
+func layer(name, parent string) routelayerv1.Layer {
+	return routelayerv1.Layer{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       routelayerv1.LayerSpec{Parent: parent},
+	}
+}
+
+func layerService(name, layer string, labels map[string]string) routelayerv1.LayerService {
+	return routelayerv1.LayerService{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: routelayerv1.LayerServiceSpec{
+			Layer:  layer,
+			Host:   host,
+			Labels: labels,
+		},
+	}
+}
+
+// rendered returns a section (http, tcp, tls) of a rendered VirtualService.
+func rendered(vs *unstructured.Unstructured, section string) []interface{} {
+	routes, found, err := unstructured.NestedSlice(vs.Object, "spec", section)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(found).To(BeTrue())
+	return routes
+}
+
+var _ = Describe("Route table", func() {
+	It("should have no routes when no layer overrides the host", func() {
+		t := BuildTable(host, namespace, nil, []routelayerv1.Layer{layer("v2", "")})
+		Expect(t.Routes).To(BeEmpty())
+	})
+
+	It("should route a layer to the subset defined by its labels", func() {
+		t := BuildTable(host, namespace,
+			[]routelayerv1.LayerService{layerService("echo-v2", "v2", map[string]string{"version": "v2"})},
+			[]routelayerv1.Layer{layer("v2", "")})
+
+		Expect(t.Routes).To(Equal([]Route{{Layer: "v2", Provider: "v2", Fallback: []string{"v2"}, Destination: host, Subset: "v2"}}))
+		Expect(t.Subsets).To(Equal([]Subset{{Name: "v2", Labels: map[string]string{"version": "v2"}}}))
+	})
+
+	It("should fall back to the nearest ancestor's override", func() {
+		t := BuildTable(host, namespace,
+			[]routelayerv1.LayerService{layerService("echo-v2", "v2", map[string]string{"version": "v2"})},
+			[]routelayerv1.Layer{layer("v2", ""), layer("v3", "v2"), layer("other", "")})
+
+		Expect(t.Routes).To(HaveLen(2))
+		Expect(t.Routes[1]).To(Equal(Route{Layer: "v3", Provider: "v2", Fallback: []string{"v3", "v2"}, Destination: host, Subset: "v2"}))
+	})
+
+	It("should fall back to the parent's override while a layer is suspended", func() {
+		layers := []routelayerv1.Layer{layer("v2", ""), layer("v3", "v2")}
+		layers[1].Spec.Suspend = true
+		t := BuildTable(host, namespace, []routelayerv1.LayerService{
+			layerService("echo-v2", "v2", map[string]string{"version": "v2"}),
+			layerService("echo-v3", "v3", map[string]string{"version": "v3"}),
+		}, layers)
+
+		Expect(t.Routes).To(HaveLen(2))
+		Expect(t.Routes[1].Provider).To(Equal("v2"))
+		Expect(t.Subsets).To(HaveLen(1))
+
+		layers[0].Spec.Suspend = true
+		t = BuildTable(host, namespace, []routelayerv1.LayerService{
+			layerService("echo-v2", "v2", map[string]string{"version": "v2"}),
+			layerService("echo-v3", "v3", map[string]string{"version": "v3"}),
+		}, layers)
+		Expect(t.Routes).To(BeEmpty(), "everything takes the default route")
+	})
+
+	It("should ignore LayerServices for layers which do not exist", func() {
+		t := BuildTable(host, namespace,
+			[]routelayerv1.LayerService{layerService("echo-v2", "v2", map[string]string{"version": "v2"})},
+			nil)
+		Expect(t.Routes).To(BeEmpty())
+	})
+
+	It("should not loop on a cycle of parents", func() {
+		t := BuildTable(host, namespace,
+			[]routelayerv1.LayerService{layerService("echo-v2", "v2", map[string]string{"version": "v2"})},
+			[]routelayerv1.Layer{layer("v2", ""), layer("a", "b"), layer("b", "a")})
+		Expect(t.Routes).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("VirtualService", func() {
+	It("should set the layer header on every layer route", func() {
+		t := BuildTable(host, namespace,
+			[]routelayerv1.LayerService{layerService("echo-v2", "v2", map[string]string{"version": "v2"})},
+			[]routelayerv1.Layer{layer("v2", "")})
+		vs := VirtualService(t, DefaultLayerHeader)
+
+		Expect(vs.GetName()).To(Equal("routelayer-http-echo"))
+		Expect(vs.GetNamespace()).To(Equal(namespace))
+		Expect(vs.GetAnnotations()).To(HaveKeyWithValue(HostAnnotation, host))
+		exportTo, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "exportTo")
+		Expect(exportTo).To(Equal([]string{"*"}))
+
+		routes := rendered(vs, "http")
+		Expect(routes).To(HaveLen(2))
+		set, _, _ := unstructured.NestedStringMap(routes[0].(map[string]interface{}), "headers", "request", "set")
+		Expect(set).To(Equal(map[string]string{DefaultLayerHeader: "v2"}))
+
+		// the last route is the default, which is not tied to a layer
+		Expect(routes[1].(map[string]interface{})).NotTo(HaveKey("headers"))
+	})
+
+	It("should add entry routes after all the header routes", func() {
+		layers := []routelayerv1.Layer{layer("a", ""), layer("b", "")}
+		layers[0].Spec.Entry = &routelayerv1.LayerEntry{Cookie: "x-route", QueryParam: "layer", Subdomain: true}
+		t := BuildTable(host, namespace, []routelayerv1.LayerService{
+			layerService("echo-a", "a", map[string]string{"version": "a"}),
+			layerService("echo-b", "b", map[string]string{"version": "b"}),
+		}, layers)
+
+		routes := rendered(VirtualService(t, "x-layer"), "http")
+		names := []string{}
+		for _, r := range routes {
+			names = append(names, r.(map[string]interface{})["name"].(string))
+		}
+		Expect(names).To(Equal([]string{"a", "b", "a-entry", "default"}))
+
+		entry := routes[2].(map[string]interface{})
+		Expect(entry["match"]).To(HaveLen(3))
+		set, _, _ := unstructured.NestedStringMap(entry, "headers", "request", "set")
+		Expect(set).To(Equal(map[string]string{"x-layer": "a"}))
+	})
+
+	It("should match a cookie anywhere in the cookie header", func() {
+		re := regexp.MustCompile(CookieRegex("x-route", "feature-x"))
+		Expect(re.MatchString("x-route=feature-x")).To(BeTrue())
+		Expect(re.MatchString("a=b; x-route=feature-x; c=d")).To(BeTrue())
+		Expect(re.MatchString("x-route=feature-xy")).To(BeFalse())
+		Expect(re.MatchString("my-x-route=feature-x")).To(BeFalse())
+	})
+})
+
+var _ = Describe("Enrollment", func() {
+	enrolled := func(enrollment *routelayerv1.LayerEnrollment) []interface{} {
+		layers := []routelayerv1.Layer{layer("a", "")}
+		layers[0].Spec.Enrollment = enrollment
+		t := BuildTable(host, namespace,
+			[]routelayerv1.LayerService{layerService("echo-a", "a", map[string]string{"version": "a"})}, layers)
+		return rendered(VirtualService(t, DefaultLayerHeader), "http")
+	}
+	names := func(routes []interface{}) []string {
+		names := []string{}
+		for _, r := range routes {
+			names = append(names, r.(map[string]interface{})["name"].(string))
+		}
+		return names
+	}
+
+	It("should keep enrolled users in the layer and sample the others", func() {
+		routes := enrolled(&routelayerv1.LayerEnrollment{Percentage: 10})
+		Expect(names(routes)).To(Equal([]string{"a", "a-enrolled", "a-sample", "default"}))
+
+		regex, _, _ := unstructured.NestedString(routes[1].(map[string]interface{})["match"].([]interface{})[0].(map[string]interface{}),
+			"headers", "cookie", "regex")
+		Expect(regex).To(Equal(CookieRegex("routelayer-a", "a")))
+
+		sample := routes[2].(map[string]interface{})["route"].([]interface{})
+		Expect(sample).To(HaveLen(2))
+		in, out := sample[0].(map[string]interface{}), sample[1].(map[string]interface{})
+		Expect(in["weight"]).To(Equal(int64(10)))
+		Expect(out["weight"]).To(Equal(int64(90)))
+		set, _, _ := unstructured.NestedStringMap(in, "headers", "request", "set")
+		Expect(set).To(Equal(map[string]string{DefaultLayerHeader: "a"}))
+		cookie, _, _ := unstructured.NestedString(in, "headers", "response", "add", "set-cookie")
+		Expect(cookie).To(HavePrefix("routelayer-a=a;"))
+		cookie, _, _ = unstructured.NestedString(out, "headers", "response", "add", "set-cookie")
+		Expect(cookie).To(HavePrefix("routelayer-a=" + NotEnrolled + ";"))
+		// the calls the request makes carry the header, they aren't drawn again.
+		set, _, _ = unstructured.NestedStringMap(out, "headers", "request", "set")
+		Expect(set).To(Equal(map[string]string{DefaultLayerHeader: NotEnrolled}))
+		without := routes[2].(map[string]interface{})["match"].([]interface{})[0].(map[string]interface{})["withoutHeaders"]
+		Expect(without).To(HaveKey(DefaultLayerHeader))
+	})
+
+	It("should only keep enrolled users once the percentage is 0", func() {
+		Expect(names(enrolled(&routelayerv1.LayerEnrollment{Percentage: 0, HashHeader: "x-user-id"}))).
+			To(Equal([]string{"a", "a-enrolled", "default"}))
+	})
+
+	It("should enroll the users in the cohort of their hash key", func() {
+		routes := enrolled(&routelayerv1.LayerEnrollment{Percentage: 25, HashHeader: "X-User-Id"})
+		Expect(names(routes)).To(Equal([]string{"a", "a-enrolled", "a-cohort", "a-sample", "default"}))
+
+		regex, _, _ := unstructured.NestedString(routes[2].(map[string]interface{})["match"].([]interface{})[0].(map[string]interface{}),
+			"headers", "x-user-id", "regex")
+		re := regexp.MustCompile(regex)
+		Expect(re.MatchString("6ba7b810-9dad-11d1-80b4-00c04fd43018")).To(BeTrue())
+		Expect(re.MatchString("6ba7b810-9dad-11d1-80b4-00c04fd4301A")).To(BeTrue())
+		Expect(re.MatchString("6ba7b810-9dad-11d1-80b4-00c04fd43040")).To(BeFalse())
+
+		without := routes[3].(map[string]interface{})["match"].([]interface{})[0].(map[string]interface{})["withoutHeaders"]
+		Expect(without).To(HaveKey("x-user-id"))
+	})
+
+	It("should divide hash keys into 256 cohorts", func() {
+		re := regexp.MustCompile("^" + CohortRegex(50) + "$")
+		in := 0
+		for i := 0; i < 256; i++ {
+			if re.MatchString(fmt.Sprintf("%02x", i)) {
+				in++
+			}
+		}
+		Expect(in).To(Equal(128))
+		Expect(CohortRegex(0)).To(BeEmpty())
+		Expect(regexp.MustCompile("^" + CohortRegex(100) + "$").MatchString("fF")).To(BeTrue())
+	})
+})
+
+var _ = Describe("ServiceEntries", func() {
+	It("should make a destination in another cluster known by its ready endpoints", func() {
+		destination := "echo-west.other.svc.cluster.local"
+		svc := &corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 80}, {Name: "", Port: 9090}}}}
+		name, target, ready := "http", int32(5678), false
+		slices := []discoveryv1.EndpointSlice{{
+			Ports: []discoveryv1.EndpointPort{{Name: &name, Port: &target}},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.1.0.8"}},
+				{Addresses: []string{"10.1.0.7"}},
+				{Addresses: []string{"10.1.0.9"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+			},
+		}}
+
+		se := ServiceEntry(host, namespace, destination, svc, slices)
+		Expect(se.GetName()).To(Equal("routelayer-http-echo-" + destination))
+		Expect(se.GetAnnotations()).To(HaveKeyWithValue(HostAnnotation, host))
+		hosts, _, _ := unstructured.NestedStringSlice(se.Object, "spec", "hosts")
+		Expect(hosts).To(Equal([]string{destination}))
+		ports, _, _ := unstructured.NestedSlice(se.Object, "spec", "ports")
+		Expect(ports).To(Equal([]interface{}{
+			map[string]interface{}{"number": int64(80), "name": "http"},
+			map[string]interface{}{"number": int64(9090), "name": "port-9090"},
+		}))
+		endpoints, _, _ := unstructured.NestedSlice(se.Object, "spec", "endpoints")
+		Expect(endpoints).To(Equal([]interface{}{
+			map[string]interface{}{"address": "10.1.0.7", "ports": map[string]interface{}{"http": int64(5678)}},
+			map[string]interface{}{"address": "10.1.0.8", "ports": map[string]interface{}{"http": int64(5678)}},
+		}))
+	})
+})
+
+var _ = Describe("External hosts", func() {
+	const (
+		api     = "api.payments.example.com"
+		sandbox = "sandbox.payments.example.com"
+	)
+	external := func(tls bool, ports ...uint32) Table {
+		ls := layerService("sandbox", "test", nil)
+		ls.Spec.Host = api
+		ls.Spec.Destination = sandbox
+		ls.Spec.DestinationTLS = tls
+		ls.Spec.Ports = ports
+		t := BuildTable(api, namespace, []routelayerv1.LayerService{ls}, []routelayerv1.Layer{layer("test", "")})
+		return MarkExternal(t, DefaultClusterDomain)
+	}
+
+	It("should only mark names which are not cluster services external", func() {
+		t := MarkExternal(Table{Host: "http-echo.demo.svc.cluster.local", Routes: []Route{
+			{Layer: "a", Destination: "http-echo-v2.demo.svc.cluster.local"},
+			{Layer: "b", Destination: sandbox},
+		}}, DefaultClusterDomain)
+		Expect(t.External).To(BeFalse())
+		Expect(t.Routes[0].External).To(BeFalse())
+		Expect(t.Routes[1].External).To(BeTrue())
+	})
+
+	It("should route to a destination of two labels ending in a dot outside the cluster", func() {
+		ls := layerService("httpbin", "test", nil)
+		ls.Spec.Host = api
+		ls.Spec.Destination = "httpbin.org."
+		ls = Normalize(ls, DefaultClusterDomain)
+		Expect(ls.Spec.Destination).To(Equal("httpbin.org"))
+		t := MarkExternal(BuildTable(api, namespace, []routelayerv1.LayerService{ls}, []routelayerv1.Layer{layer("test", "")}),
+			DefaultClusterDomain)
+		Expect(t.Routes[0].External).To(BeTrue())
+		resources := ExternalResources(t)
+		Expect(resources).To(HaveLen(2))
+		Expect(resources[1].GetName()).To(Equal(ServiceEntryName(api, "httpbin.org")))
+	})
+
+	It("should send the layer to the destination by its own name", func() {
+		routes := rendered(VirtualService(external(false), DefaultLayerHeader), "http")
+		Expect(routes[0]).To(HaveKeyWithValue("rewrite", map[string]interface{}{"authority": sandbox}))
+		Expect(routes[len(routes)-1]).NotTo(HaveKey("rewrite"))
+	})
+
+	It("should send users sampled into the layer to the destination by its own name", func() {
+		sample := func(percentage int32) map[string]interface{} {
+			t := external(false)
+			t.Routes[0].Enrollment = &routelayerv1.LayerEnrollment{Percentage: percentage}
+			routes := rendered(VirtualService(t, DefaultLayerHeader), "http")
+			return routes[len(routes)-2].(map[string]interface{})
+		}
+		Expect(sample(100)).To(HaveKeyWithValue("name", "test-sample"))
+		Expect(sample(100)).To(HaveKeyWithValue("rewrite", map[string]interface{}{"authority": sandbox}))
+		Expect(sample(50)).NotTo(HaveKey("rewrite"), "the users not sampled go on to the host")
+	})
+
+	It("should make the host and the destination known to the mesh", func() {
+		resources := ExternalResources(external(false, 8080))
+		Expect(resources).To(HaveLen(2))
+		Expect(resources[0].GetName()).To(Equal(Name(api)))
+		Expect(resources[1].GetName()).To(Equal(ServiceEntryName(api, sandbox)))
+		for _, se := range resources {
+			Expect(se.GetKind()).To(Equal("ServiceEntry"))
+			Expect(se.GetAnnotations()).To(HaveKeyWithValue(HostAnnotation, api))
+			spec := se.Object["spec"].(map[string]interface{})
+			Expect(spec).To(HaveKeyWithValue("location", "MESH_EXTERNAL"))
+			Expect(spec).To(HaveKeyWithValue("ports", []interface{}{
+				map[string]interface{}{"number": int64(8080), "name": "http-8080", "protocol": "HTTP"},
+			}))
+		}
+	})
+
+	It("should originate TLS to a destination served over TLS", func() {
+		resources := ExternalResources(external(true))
+		Expect(resources).To(HaveLen(3))
+		ports, _, _ := unstructured.NestedSlice(resources[1].Object, "spec", "ports")
+		Expect(ports).To(Equal([]interface{}{
+			map[string]interface{}{"number": int64(DefaultExternalPort), "name": "http-80", "protocol": "HTTP",
+				"targetPort": int64(ExternalTLSPort)},
+		}))
+		dr := resources[2]
+		Expect(dr.GetKind()).To(Equal("DestinationRule"))
+		Expect(dr.GetName()).To(Equal(ServiceEntryName(api, sandbox)))
+		tls, _, _ := unstructured.NestedStringMap(dr.Object, "spec", "trafficPolicy", "tls")
+		Expect(tls).To(Equal(map[string]string{"mode": "SIMPLE", "sni": sandbox}))
+	})
+
+	It("should need nothing once no layer routes the host", func() {
+		Expect(ExternalResources(Table{Host: api, Namespace: namespace, External: true})).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Egress gateways", func() {
+	const (
+		api     = "api.payments.example.com"
+		sandbox = "sandbox.payments.example.com"
+		egress  = "istio-egressgateway.istio-system.svc.cluster.local"
+		tests   = "test-egressgateway.istio-system.svc.cluster.local"
+	)
+	table := func(gateway string, destinations ...string) Table {
+		services := []routelayerv1.LayerService{}
+		layers := []routelayerv1.Layer{}
+		for i, destination := range destinations {
+			name := fmt.Sprintf("layer-%d", i)
+			ls := layerService(name, name, nil)
+			ls.Spec.Host = api
+			ls.Spec.Destination = destination
+			ls.Spec.EgressGateway = gateway
+			services = append(services, ls)
+			layers = append(layers, layer(name, ""))
+		}
+		t := BuildTable(api, namespace, services, layers)
+		return RouteEgress(MarkExternal(t, DefaultClusterDomain), egress)
+	}
+
+	It("should send a layer out through its own gateway, or else the default", func() {
+		t := table(tests, sandbox)
+		Expect(t.Egress).To(Equal(egress))
+		Expect(t.Routes[0].Egress).To(Equal(tests))
+		Expect(EgressGateways(t)).To(Equal([]string{egress, tests}))
+
+		t = table("", sandbox, "payments-mock.demo.svc.cluster.local")
+		Expect(t.Routes[0].Egress).To(Equal(egress))
+		Expect(t.Routes[1].Egress).To(BeEmpty(), "a destination inside the cluster is routed to directly")
+	})
+
+	It("should not send requests for hosts inside the cluster, or opaque ones, through a gateway", func() {
+		t := RouteEgress(MarkExternal(Table{Host: "http-echo.demo.svc.cluster.local", Protocol: routelayerv1.ProtocolHTTP,
+			Routes: []Route{{Layer: "a", Destination: sandbox, Egress: tests}}}, DefaultClusterDomain), egress)
+		Expect(EgressGateways(t)).To(BeEmpty())
+
+		t = RouteEgress(MarkExternal(Table{Host: api, Protocol: routelayerv1.ProtocolTLS,
+			Routes: []Route{{Layer: "a", Destination: sandbox}}}, DefaultClusterDomain), egress)
+		Expect(EgressGateways(t)).To(BeEmpty())
+	})
+
+	It("should send requests from the sidecars to the gateways, with their layer header", func() {
+		routes := rendered(VirtualService(table(tests, sandbox), DefaultLayerHeader), "http")
+		Expect(routes[0]).To(HaveKeyWithValue("route", []interface{}{
+			map[string]interface{}{"destination": map[string]interface{}{
+				"host": tests, "subset": EgressSubset(api), "port": map[string]interface{}{"number": int64(EgressPort)},
+			}},
+		}))
+		Expect(routes[0]).NotTo(HaveKey("rewrite"), "the gateway rewrites the authority")
+		Expect(routes[0]).To(HaveKeyWithValue("headers", HaveKeyWithValue("request",
+			HaveKeyWithValue("set", HaveKeyWithValue(DefaultLayerHeader, "layer-0")))))
+		Expect(routes[len(routes)-1]).To(HaveKeyWithValue("route", []interface{}{
+			map[string]interface{}{"destination": map[string]interface{}{
+				"host": egress, "subset": EgressSubset(api), "port": map[string]interface{}{"number": int64(EgressPort)},
+			}},
+		}))
+	})
+
+	It("should route the requests leaving the gateways by their layer", func() {
+		resources := EgressResources(table(tests, sandbox), DefaultLayerHeader, map[string]map[string]string{
+			egress: {"istio": "egressgateway"},
+			tests:  {"istio": "test-egressgateway"},
+		})
+		Expect(resources).To(HaveLen(5))
+
+		gw, dr := resources[2], resources[3]
+		Expect(gw.GetKind()).To(Equal("Gateway"))
+		Expect(gw.GetName()).To(Equal(EgressName(api, tests)))
+		selector, _, _ := unstructured.NestedStringMap(gw.Object, "spec", "selector")
+		Expect(selector).To(Equal(map[string]string{"istio": "test-egressgateway"}))
+		servers, _, _ := unstructured.NestedSlice(gw.Object, "spec", "servers")
+		Expect(servers).To(HaveLen(1))
+		Expect(servers[0]).To(HaveKeyWithValue("hosts", []interface{}{api}))
+		Expect(dr.GetKind()).To(Equal("DestinationRule"))
+		Expect(dr.Object["spec"]).To(HaveKeyWithValue("host", tests))
+		Expect(dr.Object["spec"]).To(HaveKeyWithValue("subsets", []interface{}{
+			map[string]interface{}{"name": EgressSubset(api)},
+		}))
+
+		vs := resources[4]
+		Expect(vs.GetName()).To(Equal(EgressVirtualServiceName(api)))
+		gateways, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "gateways")
+		Expect(gateways).To(Equal([]string{namespace + "/" + EgressName(api, egress), namespace + "/" + EgressName(api, tests)}))
+		routes := rendered(vs, "http")
+		Expect(routes).To(HaveLen(2))
+		Expect(routes[0]).To(HaveKeyWithValue("match", []interface{}{
+			map[string]interface{}{"headers": map[string]interface{}{DefaultLayerHeader: map[string]interface{}{"exact": "layer-0"}}},
+		}))
+		Expect(routes[0]).To(HaveKeyWithValue("rewrite", map[string]interface{}{"authority": sandbox}))
+		Expect(routes[0]).To(HaveKeyWithValue("route", []interface{}{
+			map[string]interface{}{"destination": map[string]interface{}{
+				"host": sandbox, "port": map[string]interface{}{"number": int64(DefaultExternalPort)},
+			}},
+		}))
+		Expect(routes[1]).To(HaveKeyWithValue("route", []interface{}{
+			map[string]interface{}{"destination": map[string]interface{}{
+				"host": api, "port": map[string]interface{}{"number": int64(DefaultExternalPort)},
+			}},
+		}))
+	})
+
+	It("should name the gateway subset of a host with a DNS label", func() {
+		Expect(EgressSubset(api)).To(Equal("api-payments-example-com"))
+		long := EgressSubset("a-very-long-name-for-an-external-api.sandbox.payments-provider.example.com")
+		Expect(long).To(HaveLen(63))
+		Expect(long).To(MatchRegexp(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`))
+	})
+})
+
+var _ = Describe("DestinationRule", func() {
+	It("should not be rendered without subsets", func() {
+		ls := layerService("echo-v2", "v2", nil)
+		ls.Spec.Destination = "http-echo-v2"
+		t := BuildTable(host, namespace, []routelayerv1.LayerService{ls}, []routelayerv1.Layer{layer("v2", "")})
+		Expect(DestinationRule(t)).To(BeNil())
+	})
+
+	It("should define a subset per overriding layer", func() {
+		t := BuildTable(host, namespace,
+			[]routelayerv1.LayerService{layerService("echo-v2", "v2", map[string]string{"version": "v2"})},
+			[]routelayerv1.Layer{layer("v2", ""), layer("v3", "v2")})
+		dr := DestinationRule(t)
+		subsets, _, _ := unstructured.NestedSlice(dr.Object, "spec", "subsets")
+		Expect(subsets).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("gRPC hosts", func() {
+	var t Table
+
+	BeforeEach(func() {
+		ls := layerService("echo-v2", "v2", map[string]string{"version": "v2"})
+		ls.Spec.Protocol = routelayerv1.ProtocolGRPC
+		ls.Spec.Ports = []uint32{7070}
+		t = BuildTable(host, namespace, []routelayerv1.LayerService{ls}, []routelayerv1.Layer{layer("v2", "")})
+	})
+
+	It("should match the layer metadata on the service port", func() {
+		Expect(t.Protocol).To(Equal(routelayerv1.ProtocolGRPC))
+
+		// gRPC metadata keys are always lower case
+		routes := rendered(VirtualService(t, "X-Route"), "http")
+		match := routes[0].(map[string]interface{})["match"].([]interface{})[0].(map[string]interface{})
+		Expect(match).To(HaveKeyWithValue("port", int64(7070)))
+		Expect(match["headers"]).To(HaveKey("x-route"))
+
+		destination := routes[0].(map[string]interface{})["route"].([]interface{})[0].(map[string]interface{})["destination"]
+		Expect(destination).To(HaveKeyWithValue("port", map[string]interface{}{"number": int64(7070)}))
+	})
+
+	It("should balance connections in the DestinationRule", func() {
+		dr := DestinationRule(t)
+		lb, _, _ := unstructured.NestedString(dr.Object, "spec", "trafficPolicy", "loadBalancer", "simple")
+		Expect(lb).To(Equal("LEAST_REQUEST"))
+		upgrade, _, _ := unstructured.NestedString(dr.Object, "spec", "trafficPolicy", "connectionPool", "http", "h2UpgradePolicy")
+		Expect(upgrade).To(Equal("UPGRADE"))
+	})
+
+	It("should render a DestinationRule for http2 even without subsets", func() {
+		ls := layerService("echo-v2", "v2", nil)
+		ls.Spec.Destination = "http-echo-v2"
+		ls.Spec.Protocol = routelayerv1.ProtocolHTTP2
+		t := BuildTable(host, namespace, []routelayerv1.LayerService{ls}, []routelayerv1.Layer{layer("v2", "")})
+		Expect(DestinationRule(t)).NotTo(BeNil())
+	})
+})
+
+var _ = Describe("TCP and TLS hosts", func() {
+	newTable := func(protocol string, ports ...uint32) Table {
+		ls := layerService("db-feature-x", "feature-x", map[string]string{"version": "feature-x"})
+		ls.Spec.Host = "db"
+		ls.Spec.Protocol = protocol
+		ls.Spec.Ports = ports
+		return BuildTable("db", namespace, []routelayerv1.LayerService{ls}, []routelayerv1.Layer{layer("feature-x", "")})
+	}
+
+	It("should route a tcp layer by its port", func() {
+		vs := VirtualService(newTable(routelayerv1.ProtocolTCP, 15432, 15433), DefaultLayerHeader)
+		Expect(vs.Object["spec"]).NotTo(HaveKey("http"))
+
+		routes := rendered(vs, "tcp")
+		Expect(routes).To(HaveLen(3))
+		for i, port := range []int64{15432, 15433} {
+			Expect(routes[i]).To(HaveKeyWithValue("match", []interface{}{map[string]interface{}{"port": port}}))
+			Expect(routes[i]).To(HaveKeyWithValue("route", []interface{}{
+				map[string]interface{}{"destination": map[string]interface{}{
+					"host": "db", "subset": "feature-x", "port": map[string]interface{}{"number": port},
+				}},
+			}))
+		}
+		Expect(routes[2]).NotTo(HaveKey("match"))
+	})
+
+	It("should route a tls layer by SNI", func() {
+		vs := VirtualService(newTable(routelayerv1.ProtocolTLS), DefaultLayerHeader)
+		hosts, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "hosts")
+		Expect(hosts).To(Equal([]string{"db", "feature-x.db"}))
+
+		routes := rendered(vs, "tls")
+		Expect(routes).To(HaveLen(2))
+		Expect(routes[0]).To(HaveKeyWithValue("match", []interface{}{
+			map[string]interface{}{"sniHosts": []interface{}{"feature-x.db"}},
+		}))
+		Expect(routes[1]).To(HaveKeyWithValue("match", []interface{}{
+			map[string]interface{}{"sniHosts": []interface{}{"db"}},
+		}))
+	})
+
+	It("should treat the host as tcp if any layer needs it", func() {
+		Expect(moreCapable(routelayerv1.ProtocolGRPC, routelayerv1.ProtocolTCP)).To(Equal(routelayerv1.ProtocolTCP))
+		Expect(moreCapable(routelayerv1.ProtocolTLS, routelayerv1.ProtocolHTTP)).To(Equal(routelayerv1.ProtocolTLS))
+		Expect(moreCapable(routelayerv1.ProtocolHTTP, "")).To(Equal(routelayerv1.ProtocolHTTP))
+	})
+})
+
+var _ = Describe("Multi-port hosts", func() {
+	It("should only route the layer's ports", func() {
+		ls := layerService("echo-v2", "v2", map[string]string{"version": "v2"})
+		ls.Spec.Ports = []uint32{8080, 8443}
+		t := BuildTable(host, namespace, []routelayerv1.LayerService{ls}, []routelayerv1.Layer{layer("v2", "")})
+
+		routes := rendered(VirtualService(t, DefaultLayerHeader), "http")
+		Expect(routes).To(HaveLen(3))
+		for i, port := range []int64{8080, 8443} {
+			route := routes[i].(map[string]interface{})
+			Expect(route["name"]).To(Equal(fmt.Sprintf("v2-%d", port)))
+			match := route["match"].([]interface{})[0].(map[string]interface{})
+			Expect(match).To(HaveKeyWithValue("port", port))
+			destination, _, _ := unstructured.NestedInt64(
+				route["route"].([]interface{})[0].(map[string]interface{}), "destination", "port", "number")
+			Expect(destination).To(Equal(port))
+		}
+		// any other port (e.g. metrics) is left on the default route
+		Expect(routes[2]).To(HaveKeyWithValue("name", "default"))
+	})
+})
+
+var _ = Describe("Host names", func() {
+	It("should normalize hosts relative to the namespace", func() {
+		Expect(FQDN("http-echo", namespace, DefaultClusterDomain)).To(Equal("http-echo.routing-demo.svc.cluster.local"))
+		Expect(FQDN("http-echo.other", namespace, DefaultClusterDomain)).To(Equal("http-echo.other.svc.cluster.local"))
+		Expect(FQDN("http-echo.other.svc", namespace, DefaultClusterDomain)).To(Equal("http-echo.other.svc.cluster.local"))
+		Expect(FQDN("Http-Echo.other.svc.cluster.local.", namespace, DefaultClusterDomain)).
+			To(Equal("http-echo.other.svc.cluster.local"))
+		Expect(FQDN("api.example.com", namespace, DefaultClusterDomain)).To(Equal("api.example.com"))
+		Expect(FQDN("HttpBin.org.", namespace, DefaultClusterDomain)).To(Equal("httpbin.org"))
+		Expect(Absolute("httpbin.org.", namespace, DefaultClusterDomain)).To(Equal("httpbin.org."))
+		Expect(Absolute("http-echo", namespace, DefaultClusterDomain)).To(Equal("http-echo.routing-demo.svc.cluster.local"))
+	})
+
+	It("should find the namespace of cluster hosts only", func() {
+		ns, ok := HostNamespace("http-echo.other.svc.cluster.local", DefaultClusterDomain)
+		Expect(ok).To(BeTrue())
+		Expect(ns).To(Equal("other"))
+
+		_, ok = HostNamespace("api.example.com", DefaultClusterDomain)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should let LayerServices written differently override the same host", func() {
+		short := layerService("echo-v2", "v2", map[string]string{"version": "v2"})
+		qualified := layerService("echo-v3", "v3", map[string]string{"version": "v3"})
+		qualified.Namespace = "other"
+		qualified.Spec.Host = "http-echo.routing-demo"
+
+		fqdn := FQDN(host, namespace, DefaultClusterDomain)
+		t := BuildTable(fqdn, namespace, []routelayerv1.LayerService{
+			Normalize(short, DefaultClusterDomain),
+			Normalize(qualified, DefaultClusterDomain),
+		}, []routelayerv1.Layer{layer("v2", ""), layer("v3", "")})
+		Expect(t.Routes).To(HaveLen(2))
+		Expect(short.Spec.Host).To(Equal(host), "the original is not changed")
+	})
+})
+
+var _ = Describe("Adopting VirtualServices", func() {
+	// a VirtualService written by hand, like routing-test/resources/istio.yaml
+	handWritten := func() *unstructured.Unstructured {
+		vs := NewVirtualService("http-echo", namespace)
+		vs.Object["spec"] = map[string]interface{}{
+			"hosts": []interface{}{host},
+			"http": []interface{}{
+				map[string]interface{}{
+					"route": []interface{}{
+						map[string]interface{}{"destination": map[string]interface{}{"host": host, "subset": "v1"}},
+					},
+				},
+			},
+		}
+		return vs
+	}
+	names := func(vs *unstructured.Unstructured) []interface{} {
+		names := []interface{}{}
+		for _, r := range rendered(vs, "http") {
+			names = append(names, r.(map[string]interface{})["name"])
+		}
+		return names
+	}
+	table := func(layers ...string) Table {
+		services := []routelayerv1.LayerService{}
+		for _, l := range layers {
+			services = append(services, layerService("echo-"+l, l, map[string]string{"version": l}))
+		}
+		return BuildTable(host, namespace, services, []routelayerv1.Layer{layer("v2", ""), layer("v3", "")})
+	}
+
+	It("should find VirtualServices routing the host for the mesh", func() {
+		fqdn := FQDN(host, namespace, DefaultClusterDomain)
+		vs := handWritten()
+		Expect(Owned(vs)).To(BeFalse())
+		Expect(RoutesHost(vs, fqdn, DefaultClusterDomain)).To(BeTrue())
+
+		vs.Object["spec"].(map[string]interface{})["gateways"] = []interface{}{"ingress"}
+		Expect(RoutesHost(vs, fqdn, DefaultClusterDomain)).To(BeFalse())
+	})
+
+	It("should add the layer routes in front of the existing routes", func() {
+		vs := Adopt(handWritten(), table("v2"), DefaultLayerHeader)
+		Expect(vs.GetName()).To(Equal("http-echo"))
+		Expect(vs.GetLabels()).NotTo(HaveKey(ManagedByLabel))
+		Expect(Adopted(vs)).To(BeTrue())
+		Expect(names(vs)).To(Equal([]interface{}{"v2", nil}))
+	})
+
+	It("should replace the layer routes of a previous adoption", func() {
+		adopted := Adopt(handWritten(), table("v2"), DefaultLayerHeader)
+		vs := Adopt(adopted, table("v3"), DefaultLayerHeader)
+		Expect(names(vs)).To(Equal([]interface{}{"v3", nil}))
+	})
+
+	It("should restore the existing routes when released", func() {
+		adopted := Adopt(handWritten(), table("v2"), DefaultLayerHeader)
+		vs := Adopt(adopted, Table{Host: host}, DefaultLayerHeader)
+		Expect(Adopted(vs)).To(BeFalse())
+		Expect(rendered(vs, "http")).To(Equal(rendered(handWritten(), "http")))
+	})
+
+	It("should remove the SNI hosts it added when released", func() {
+		written := handWritten()
+		Expect(unstructured.SetNestedSlice(written.Object,
+			[]interface{}{host, SNIHost("v3", host)}, "spec", "hosts")).To(Succeed())
+		tls := table("v2", "v3")
+		tls.Protocol = routelayerv1.ProtocolTLS
+
+		adopted := Adopt(written, tls, DefaultLayerHeader)
+		Expect(adopted.Object["spec"]).To(HaveKeyWithValue("hosts",
+			[]interface{}{host, SNIHost("v3", host), SNIHost("v2", host)}))
+		Expect(adopted.GetAnnotations()).To(HaveKeyWithValue(AdoptedHostsAnnotation, SNIHost("v2", host)))
+
+		vs := Adopt(adopted, Table{Host: host}, DefaultLayerHeader)
+		Expect(vs.Object["spec"]).To(HaveKeyWithValue("hosts", []interface{}{host, SNIHost("v3", host)}))
+		Expect(vs.GetAnnotations()).NotTo(HaveKey(AdoptedHostsAnnotation))
+	})
+})
+
+var _ = Describe("Drift", func() {
+	generated := func() *unstructured.Unstructured {
+		t := BuildTable(host, namespace,
+			[]routelayerv1.LayerService{layerService("echo-v2", "v2", map[string]string{"version": "v2"})},
+			[]routelayerv1.Layer{layer("v2", "")})
+		return VirtualService(t, DefaultLayerHeader)
+	}
+
+	It("should not report the spec routelayer applied", func() {
+		Expect(Drifted(generated())).To(BeFalse())
+	})
+
+	It("should report a spec changed by someone else", func() {
+		vs := generated()
+		Expect(unstructured.SetNestedStringSlice(vs.Object, []string{"mesh", "ingress"}, "spec", "gateways")).To(Succeed())
+		vs.SetManagedFields([]metav1.ManagedFieldsEntry{
+			{Manager: FieldManager, FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:http":{}}}`)}},
+			{Manager: "kubectl-edit", FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:gateways":{}}}`)}},
+			{Manager: "kubectl-label", FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:labels":{}}}`)}},
+		})
+		Expect(Drifted(vs)).To(BeTrue())
+		Expect(Writers(vs)).To(Equal([]string{"kubectl-edit"}))
+	})
+
+	It("should not report resources generated before the spec was recorded", func() {
+		vs := generated()
+		vs.SetAnnotations(map[string]string{HostAnnotation: host})
+		vs.Object["spec"] = map[string]interface{}{}
+		Expect(Drifted(vs)).To(BeFalse())
+	})
+})
+
+var _ = Describe("Snapshots", func() {
+	table := func(labels map[string]string) Table {
+		return BuildTable(host, namespace,
+			[]routelayerv1.LayerService{layerService("echo-v2", "v2", labels)},
+			[]routelayerv1.Layer{layer("v2", ""), layer("v3", "v2")})
+	}
+
+	It("should keep the route table and its revision", func() {
+		t := table(map[string]string{"version": "v2"})
+		cm, err := NewSnapshot(t, 3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cm.Name).To(Equal("routelayer-http-echo-3"))
+		Expect(cm.Namespace).To(Equal(namespace))
+		Expect(cm.Labels).To(Equal(SnapshotLabels(host)))
+
+		read, revision, err := ReadSnapshot(cm)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(revision).To(Equal(int64(3)))
+		Expect(read).To(Equal(t))
+		Expect(SameRoutes(read, t)).To(BeTrue())
+		Expect(SameRoutes(read, table(map[string]string{"version": "v3"}))).To(BeFalse())
+	})
+
+	It("should order snapshots newest first", func() {
+		snapshots := []corev1.ConfigMap{}
+		for _, revision := range []int64{2, 10, 1} {
+			cm, err := NewSnapshot(table(map[string]string{"version": "v2"}), revision)
+			Expect(err).NotTo(HaveOccurred())
+			snapshots = append(snapshots, *cm)
+		}
+		SortSnapshots(snapshots)
+		Expect(snapshots[0].Name).To(Equal("routelayer-http-echo-10"))
+		Expect(snapshots[2].Name).To(Equal("routelayer-http-echo-1"))
+	})
+
+	It("should summarize the routes with their fallback", func() {
+		Expect(LayerRoutes(table(map[string]string{"version": "v2"}))).To(Equal([]routelayerv1.LayerRoute{
+			{Layer: "v2", Destination: host, Subset: "v2", Fallback: []string{"v2"}},
+			{Layer: "v3", Destination: host, Subset: "v2", Fallback: []string{"v3", "v2"}},
+		}))
+	})
+})
+
+var _ = Describe("Layer access", func() {
+	It("should deny requests for the layer from other principals and namespaces", func() {
+		access := &routelayerv1.LayerAccess{
+			Principals: []string{"cluster.local/ns/ci/sa/tester"},
+			Namespaces: []string{"demo"},
+		}
+		ap := AuthorizationPolicy("v2", nil, DefaultRootNamespace, "X-Route-Layer", access)
+		Expect(ap.GetName()).To(Equal("routelayer-layer-v2"))
+		Expect(ap.GetNamespace()).To(Equal(DefaultRootNamespace))
+		Expect(ap.GetAnnotations()).To(HaveKeyWithValue(LayerAnnotation, "v2"))
+		Expect(ap.Object["spec"]).To(Equal(map[string]interface{}{
+			"action": "DENY",
+			"rules": []interface{}{
+				map[string]interface{}{
+					"when": []interface{}{
+						map[string]interface{}{"key": "request.headers[x-route-layer]", "values": []interface{}{"v2"}},
+					},
+					"from": []interface{}{map[string]interface{}{"source": map[string]interface{}{
+						"notPrincipals": []interface{}{"cluster.local/ns/ci/sa/tester"},
+						"notNamespaces": []interface{}{"demo"},
+					}}},
+				},
+			},
+		}))
+		Expect(RequestAuthentication(AccessName("v2"), "v2", DefaultRootNamespace, nil, access)).To(BeNil())
+	})
+
+	It("should deny requests for the layers inheriting its routes too", func() {
+		access := &routelayerv1.LayerAccess{Namespaces: []string{"demo"}}
+		ap := AuthorizationPolicy("v2", []string{"v3", "v4"}, DefaultRootNamespace, "x-route-layer", access)
+		rules := ap.Object["spec"].(map[string]interface{})["rules"].([]interface{})
+		Expect(rules[0].(map[string]interface{})["when"]).To(Equal([]interface{}{
+			map[string]interface{}{"key": "request.headers[x-route-layer]", "values": []interface{}{"v2", "v3", "v4"}},
+		}))
+	})
+
+	It("should deny requests for the layer without the JWT or any of its claims", func() {
+		access := &routelayerv1.LayerAccess{
+			JWT: &routelayerv1.LayerJWT{
+				Issuer:  "https://auth.example.com",
+				JWKSURI: "https://auth.example.com/keys",
+				Claims:  map[string][]string{"team": {"payments"}, "aud": {"preview"}},
+			},
+		}
+		ap := AuthorizationPolicy("v2", nil, "demo", "x-route-layer", access)
+		rules := ap.Object["spec"].(map[string]interface{})["rules"].([]interface{})
+		Expect(rules).To(HaveLen(3))
+		keys := []interface{}{}
+		for _, rule := range rules {
+			Expect(rule).NotTo(HaveKey("from"))
+			when := rule.(map[string]interface{})["when"].([]interface{})
+			Expect(when).To(HaveLen(2))
+			keys = append(keys, when[1].(map[string]interface{})["key"])
+		}
+		Expect(keys).To(Equal([]interface{}{
+			"request.auth.principal", "request.auth.claims[aud]", "request.auth.claims[team]",
+		}))
+
+		ra := RequestAuthentication(AccessName("v2"), "v2", "demo", nil, access)
+		Expect(ra.GetName()).To(Equal("routelayer-layer-v2"))
+		Expect(ra.Object["spec"]).To(Equal(map[string]interface{}{
+			"jwtRules": []interface{}{map[string]interface{}{
+				"issuer":               "https://auth.example.com",
+				"jwksUri":              "https://auth.example.com/keys",
+				"forwardOriginalToken": true,
+			}},
+		}))
+
+		By("validating the JWT only at the workloads selected")
+		ra = RequestAuthentication(AccessName("v2"), "v2", DefaultRootNamespace, DefaultIngressSelector, access)
+		Expect(ra.Object["spec"]).To(HaveKeyWithValue("selector", map[string]interface{}{
+			"matchLabels": map[string]interface{}{"istio": "ingressgateway"},
+		}))
+	})
+})
+
+var _ = Describe("Ingress policies", func() {
+	policy := func(allow ...routelayerv1.IngressAllowRule) *routelayerv1.IngressPolicy {
+		return &routelayerv1.IngressPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "edge"},
+			Spec:       routelayerv1.IngressPolicySpec{Allow: allow},
+		}
+	}
+
+	It("should parse IPv4 blocks as ranges", func() {
+		Expect(ParseIPBlock("10.0.0.0/8")).To(Equal(IPRange{10 << 24, 11<<24 - 1}))
+		Expect(ParseIPBlock("192.168.1.7")).To(Equal(IPRange{0xc0a80107, 0xc0a80107}))
+		Expect(ParseIPBlock("0.0.0.0/0")).To(Equal(IPRange{0, 0xffffffff}))
+		_, err := ParseIPBlock("fd00::/8")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should remove the layer header at the ingress gateways unless a rule allows it", func() {
+		ef, err := IngressEnvoyFilter(policy(
+			routelayerv1.IngressAllowRule{IPBlocks: []string{"10.0.0.0/8"}},
+			routelayerv1.IngressAllowRule{JWT: &routelayerv1.LayerJWT{
+				Issuer: "https://auth.example.com",
+				Claims: map[string][]string{"team": {"payments"}},
+			}},
+		), DefaultRootNamespace, "X-Route-Layer", IngressEntry{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ef.GetName()).To(Equal("routelayer-ingress-edge"))
+		Expect(ef.GetNamespace()).To(Equal(DefaultRootNamespace))
+
+		spec := ef.Object["spec"].(map[string]interface{})
+		Expect(spec["workloadSelector"]).To(Equal(map[string]interface{}{
+			"labels": map[string]interface{}{"istio": "ingressgateway"},
+		}))
+		patch := spec["configPatches"].([]interface{})[0].(map[string]interface{})
+		Expect(patch["match"]).To(HaveKeyWithValue("context", "GATEWAY"))
+		script := patch["patch"].(map[string]interface{})["value"].(map[string]interface{})["typed_config"].(map[string]interface{})["inlineCode"]
+		Expect(script).To(HavePrefix(`local header = "x-route-layer"
+local cookies = {}
+local params = {}
+local subdomains = {}
+local rules = {
+  {ranges = {{167772160, 184549375}, }},
+  {ranges = {}, issuer = "https://auth.example.com", claims = {["team"] = {"payments", }, }},
+}
+`))
+		Expect(script).To(ContainSubstring("headers:remove(header)"))
+	})
+
+	It("should remove the entry cookies and query parameters, and deny the entry subdomains, of the layers", func() {
+		entry := IngressEntry{}
+		entry.Add("v2", routelayerv1.LayerSpec{
+			Entry:      &routelayerv1.LayerEntry{Cookie: "x-route", QueryParam: "layer", Subdomain: true},
+			Enrollment: &routelayerv1.LayerEnrollment{Percentage: 10},
+		})
+		entry.Add("V3", routelayerv1.LayerSpec{Entry: &routelayerv1.LayerEntry{Cookie: "x-route", Subdomain: true}})
+		Expect(entry).To(Equal(IngressEntry{
+			Cookies:     []string{"x-route", "routelayer-v2", "x-route"},
+			QueryParams: []string{"layer"},
+			Subdomains:  []string{"v2", "V3"},
+		}))
+
+		ef, err := IngressEnvoyFilter(policy(routelayerv1.IngressAllowRule{IPBlocks: []string{"10.0.0.0/8"}}),
+			DefaultRootNamespace, "x-route-layer", entry)
+		Expect(err).NotTo(HaveOccurred())
+		patch := ef.Object["spec"].(map[string]interface{})["configPatches"].([]interface{})[0].(map[string]interface{})
+		script := patch["patch"].(map[string]interface{})["value"].(map[string]interface{})["typed_config"].(map[string]interface{})["inlineCode"]
+		Expect(script).To(HavePrefix(`local header = "x-route-layer"
+local cookies = {["routelayer-v2"] = true, ["x-route"] = true, }
+local params = {["layer"] = true, }
+local subdomains = {["v2"] = true, ["v3"] = true, }
+`))
+	})
+
+	It("should validate the JWTs of the rules at the ingress gateways", func() {
+		Expect(IngressRequestAuthentication(policy(routelayerv1.IngressAllowRule{IPBlocks: []string{"10.0.0.0/8"}}), DefaultRootNamespace)).To(BeNil())
+
+		jwt := &routelayerv1.LayerJWT{Issuer: "https://auth.example.com"}
+		ra := IngressRequestAuthentication(policy(
+			routelayerv1.IngressAllowRule{JWT: jwt},
+			routelayerv1.IngressAllowRule{JWT: jwt, IPBlocks: []string{"10.0.0.0/8"}},
+		), DefaultRootNamespace)
+		Expect(ra.Object["spec"]).To(Equal(map[string]interface{}{
+			"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"istio": "ingressgateway"}},
+			"jwtRules": []interface{}{map[string]interface{}{
+				"issuer":               "https://auth.example.com",
+				"forwardOriginalToken": true,
+			}},
+		}))
+	})
+
+	It("should quote lua strings", func() {
+		Expect(luaQuote(`a"b\c` + "\n")).To(Equal(`"a\"b\\c\010"`))
+	})
+})
+
+var _ = Describe("Telemetry", func() {
+	It("should tag spans with the layer header", func() {
+		t := Telemetry("routing-demo", "X-Route-Layer", "", nil)
+		Expect(t.GetName()).To(Equal(TelemetryName))
+		Expect(t.GetNamespace()).To(Equal("routing-demo"))
+		Expect(t.Object["spec"]).To(HaveKeyWithValue("tracing", []interface{}{
+			map[string]interface{}{
+				"customTags": map[string]interface{}{
+					"routelayer.layer": map[string]interface{}{
+						"header": map[string]interface{}{"name": "x-route-layer", "defaultValue": "default"},
+					},
+				},
+			},
+		}))
+	})
+
+	It("should label request metrics with the layer, when it is one of those known", func() {
+		metrics := Telemetry("routing-demo", "x-route", "", []string{"v2", "v3"}).Object["spec"].(map[string]interface{})["metrics"].([]interface{})
+		Expect(metrics).To(HaveLen(1))
+		overrides := metrics[0].(map[string]interface{})["overrides"].([]interface{})
+		Expect(overrides).To(ContainElement(map[string]interface{}{
+			"match": map[string]interface{}{"metric": "REQUEST_COUNT", "mode": "CLIENT_AND_SERVER"},
+			"tagOverrides": map[string]interface{}{
+				"routelayer_layer": map[string]interface{}{
+					"value": "'x-route' in request.headers && request.headers['x-route'] in ['v2', 'v3'] ? request.headers['x-route'] : 'default'",
+				},
+			},
+		}))
+
+		By("labelling every request default without layers")
+		metrics = Telemetry("routing-demo", "x-route", "", nil).Object["spec"].(map[string]interface{})["metrics"].([]interface{})
+		overrides = metrics[0].(map[string]interface{})["overrides"].([]interface{})
+		Expect(overrides[0]).To(HaveKeyWithValue("tagOverrides", map[string]interface{}{
+			"routelayer_layer": map[string]interface{}{"value": "'default'"},
+		}))
+	})
+
+	It("should write access logs with the provider given", func() {
+		Expect(Telemetry("routing-demo", "x-route", "", nil).Object["spec"]).NotTo(HaveKey("accessLogging"))
+		Expect(Telemetry("routing-demo", "x-route", "routelayer-envoy", nil).Object["spec"]).To(HaveKeyWithValue("accessLogging", []interface{}{
+			map[string]interface{}{"providers": []interface{}{map[string]interface{}{"name": "routelayer-envoy"}}},
+		}))
+	})
+})
@@ -0,0 +1,204 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var ServiceEntryGVK = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1", Kind: "ServiceEntry"}
+
+const (
+	// DefaultExternalPort is the port of a host outside the cluster routes for all ports are made known on.
+	DefaultExternalPort = 80
+	// ExternalTLSPort is the port the sidecar originates TLS to a destination outside the cluster on.
+	ExternalTLSPort = 443
+)
+
+// NewServiceEntry returns an empty ServiceEntry for the given name and namespace, suitable for a Get.
+func NewServiceEntry(name, namespace string) *unstructured.Unstructured {
+	return newObject(ServiceEntryGVK, name, namespace)
+}
+
+// ServiceEntryName is the name of the ServiceEntry making destination known for the routes of host.
+func ServiceEntryName(host, destination string) string {
+	return Name(host) + "-" + destination
+}
+
+// ServiceEntry renders the ServiceEntry, for the routes of host, making the cluster service destination known in a
+// cluster of the mesh which doesn't have it. svc is the service in the cluster it lives in, and slices its
+// EndpointSlices there: the ready addresses become the ServiceEntry's endpoints, so the clusters must share a network.
+func ServiceEntry(host, namespace, destination string, svc *corev1.Service, slices []discoveryv1.EndpointSlice) *unstructured.Unstructured {
+	se := newObject(ServiceEntryGVK, ServiceEntryName(host, destination), namespace)
+	setLabels(se, host)
+
+	portName := func(name string, number int32) string {
+		if name == "" {
+			return fmt.Sprintf("port-%d", number)
+		}
+		return name
+	}
+	ports := []interface{}{}
+	names := map[string]string{} // the ServiceEntry port names, by service port name
+	for _, p := range svc.Spec.Ports {
+		names[p.Name] = portName(p.Name, p.Port)
+		ports = append(ports, map[string]interface{}{
+			"number": int64(p.Port),
+			"name":   names[p.Name],
+		})
+	}
+
+	addresses := map[string]map[string]interface{}{}
+	for _, slice := range slices {
+		targets := map[string]interface{}{}
+		for _, p := range slice.Ports {
+			name := ""
+			if p.Name != nil {
+				name = *p.Name
+			}
+			if n, ok := names[name]; ok && p.Port != nil {
+				targets[n] = int64(*p.Port)
+			}
+		}
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, address := range ep.Addresses {
+				addresses[address] = targets
+			}
+		}
+	}
+	endpoints := []interface{}{}
+	for _, address := range sortedKeys(addresses) {
+		endpoint := map[string]interface{}{"address": address}
+		if len(addresses[address]) > 0 {
+			endpoint["ports"] = addresses[address]
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	se.Object["spec"] = map[string]interface{}{
+		"hosts":      []interface{}{destination},
+		"exportTo":   exportToAll(),
+		"location":   "MESH_INTERNAL",
+		"resolution": "STATIC",
+		"ports":      ports,
+		"endpoints":  endpoints,
+	}
+	setApplied(se)
+	return se
+}
+
+// ExternalResources renders what the mesh needs to route the table's host, and its destinations, outside the
+// cluster: a ServiceEntry for each - the host's named after it - with the ports of its routes, and a DestinationRule
+// for each destination the sidecar originates TLS to. A table with no routes needs none.
+func ExternalResources(t Table) []*unstructured.Unstructured {
+	resources := []*unstructured.Unstructured{}
+	if len(t.Routes) == 0 {
+		return resources
+	}
+	if t.External {
+		resources = append(resources, externalServiceEntry(Name(t.Host), t, t.Host, t.Routes))
+	}
+	destinations := map[string][]Route{}
+	for _, r := range t.Routes {
+		if r.External && r.Destination != t.Host {
+			destinations[r.Destination] = append(destinations[r.Destination], r)
+		}
+	}
+	for _, destination := range sortedKeys(destinations) {
+		routes := destinations[destination]
+		name := ServiceEntryName(t.Host, destination)
+		resources = append(resources, externalServiceEntry(name, t, destination, routes))
+		if slices.ContainsFunc(routes, func(r Route) bool { return r.TLS }) {
+			resources = append(resources, tlsOrigination(name, t, destination))
+		}
+	}
+	return resources
+}
+
+// externalServiceEntry makes the external host known to the mesh on the ports of routes, resolved by DNS.
+// When any of the routes originates TLS, every port is sent on to ExternalTLSPort.
+func externalServiceEntry(name string, t Table, host string, routes []Route) *unstructured.Unstructured {
+	se := newObject(ServiceEntryGVK, name, t.Namespace)
+	setLabels(se, t.Host)
+
+	numbers := map[uint32]bool{}
+	tls := false
+	for _, r := range routes {
+		for _, port := range ports(r) {
+			if port == 0 {
+				port = DefaultExternalPort
+			}
+			numbers[port] = true
+		}
+		tls = tls || r.TLS
+	}
+	sorted := make([]uint32, 0, len(numbers))
+	for port := range numbers {
+		sorted = append(sorted, port)
+	}
+	slices.Sort(sorted)
+	ports := []interface{}{}
+	for _, number := range sorted {
+		port := map[string]interface{}{
+			"number":   int64(number),
+			"name":     fmt.Sprintf("%s-%d", t.Protocol, number),
+			"protocol": strings.ToUpper(t.Protocol),
+		}
+		if tls {
+			port["targetPort"] = int64(ExternalTLSPort)
+		}
+		ports = append(ports, port)
+	}
+
+	se.Object["spec"] = map[string]interface{}{
+		"hosts":      []interface{}{host},
+		"exportTo":   exportToAll(),
+		"location":   "MESH_EXTERNAL",
+		"resolution": "DNS",
+		"ports":      ports,
+	}
+	setApplied(se)
+	return se
+}
+
+// tlsOrigination renders the DestinationRule having the sidecar connect to the external destination over TLS.
+func tlsOrigination(name string, t Table, destination string) *unstructured.Unstructured {
+	dr := newObject(DestinationRuleGVK, name, t.Namespace)
+	setLabels(dr, t.Host)
+	dr.Object["spec"] = map[string]interface{}{
+		"host":     destination,
+		"exportTo": exportToAll(),
+		"trafficPolicy": map[string]interface{}{
+			"tls": map[string]interface{}{
+				"mode": "SIMPLE",
+				"sni":  destination,
+			},
+		},
+	}
+	setApplied(dr)
+	return dr
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+// DefaultSnapshotRevisions is how many snapshots of a host's route table are kept when not configured.
+const DefaultSnapshotRevisions = 10
+
+const (
+	// SnapshotLabel is set on the ConfigMaps holding the route table snapshots of a host, to a hash of the host
+	// (a FQDN can be longer than a label value allows).
+	SnapshotLabel = "routelayer.github.com/snapshot-of"
+	// RevisionAnnotation records the revision of the route table a snapshot holds.
+	RevisionAnnotation = "routelayer.github.com/revision"
+	// SnapshotKey is the key of the ConfigMap data the route table is kept in, as JSON.
+	SnapshotKey = "table.json"
+)
+
+// SnapshotName is the name of the ConfigMap holding revision of the route table of host.
+func SnapshotName(host string, revision int64) string {
+	return fmt.Sprintf("%s-%d", Name(host), revision)
+}
+
+// SnapshotLabels select the snapshots of the route table of host.
+func SnapshotLabels(host string) map[string]string {
+	return map[string]string{
+		ManagedByLabel: ManagedByValue,
+		SnapshotLabel:  hash(host),
+	}
+}
+
+// NewSnapshot returns the ConfigMap holding revision of the table.
+func NewSnapshot(t Table, revision int64) (*corev1.ConfigMap, error) {
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	immutable := true
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      SnapshotName(t.Host, revision),
+			Namespace: t.Namespace,
+			Labels:    SnapshotLabels(t.Host),
+			Annotations: map[string]string{
+				HostAnnotation:     t.Host,
+				RevisionAnnotation: strconv.FormatInt(revision, 10),
+			},
+		},
+		Data:      map[string]string{SnapshotKey: string(b)},
+		Immutable: &immutable,
+	}, nil
+}
+
+// ReadSnapshot returns the route table, and its revision, held in a snapshot.
+func ReadSnapshot(cm *corev1.ConfigMap) (Table, int64, error) {
+	t := Table{}
+	revision, err := Revision(cm)
+	if err != nil {
+		return t, 0, err
+	}
+	if err := json.Unmarshal([]byte(cm.Data[SnapshotKey]), &t); err != nil {
+		return t, 0, fmt.Errorf("snapshot %s: %w", cm.Name, err)
+	}
+	return t, revision, nil
+}
+
+// Revision returns the revision of the route table a snapshot holds.
+func Revision(cm *corev1.ConfigMap) (int64, error) {
+	revision, err := strconv.ParseInt(cm.Annotations[RevisionAnnotation], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("snapshot %s has no revision: %w", cm.Name, err)
+	}
+	return revision, nil
+}
+
+// SortSnapshots orders the snapshots of a host newest first, snapshots without a revision last.
+func SortSnapshots(snapshots []corev1.ConfigMap) {
+	slices.SortFunc(snapshots, func(a, b corev1.ConfigMap) int {
+		ra, _ := Revision(&a)
+		rb, _ := Revision(&b)
+		return int(rb - ra)
+	})
+}
+
+// SameRoutes returns true if two tables route the host in the same way.
+func SameRoutes(a, b Table) bool {
+	return hash(a) == hash(b)
+}
+
+// LayerRoutes summarizes the routes of the table for LayerService status.
+func LayerRoutes(t Table) []routelayerv1.LayerRoute {
+	routes := []routelayerv1.LayerRoute{}
+	for _, r := range t.Routes {
+		routes = append(routes, routelayerv1.LayerRoute{
+			Layer:       r.Layer,
+			Destination: r.Destination,
+			Subset:      r.Subset,
+			Fallback:    r.Fallback,
+		})
+	}
+	return routes
+}
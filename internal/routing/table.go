@@ -0,0 +1,234 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package routing computes the per-host layer route tables and renders them
+// into the istio resources (VirtualService, DestinationRule) that implement them.
+package routing
+
+import (
+	"sort"
+
+	routelayerv1 "github.com/fergalsomers/routelayer/api/v1"
+)
+
+// DefaultLayerHeader is the header used to select a layer when none is configured.
+const DefaultLayerHeader = "x-route"
+
+// Table is the computed route table for a single host.
+type Table struct {
+	// Host the table routes for, a FQDN (see Normalize)
+	Host string `json:"host"`
+	// Namespace the generated resources are created in
+	Namespace string `json:"namespace"`
+	// Protocol spoken by the host, one of the routelayerv1 protocols.
+	Protocol string `json:"protocol"`
+	// Adopt - whether an existing VirtualService for the host should be adopted (see Adopt)
+	Adopt bool `json:"adopt,omitempty"`
+	// External - whether the host is outside the cluster (see MarkExternal)
+	External bool `json:"external,omitempty"`
+	// Egress - the egress gateway service requests in no layer leave the mesh through, none when empty (see RouteEgress)
+	Egress string `json:"egress,omitempty"`
+	// Routes - one per layer which has an override for the host, ordered by layer name.
+	Routes []Route `json:"routes,omitempty"`
+	// Subsets - subsets that must be defined in the DestinationRule, ordered by name.
+	Subsets []Subset `json:"subsets,omitempty"`
+}
+
+// Route is the destination for a single layer.
+type Route struct {
+	// Layer being routed
+	Layer string `json:"layer"`
+	// Provider - the layer whose LayerService supplies the destination.
+	// This is the Layer itself or, when the layer has no override for the host, its nearest ancestor that does.
+	Provider string `json:"provider"`
+	// Fallback - the layers walked from Layer to Provider, both included.
+	Fallback []string `json:"fallback"`
+	// Destination host to route to
+	Destination string `json:"destination"`
+	// External - whether the destination is outside the cluster (see MarkExternal)
+	External bool `json:"external,omitempty"`
+	// TLS - whether the sidecar originates TLS to the destination, outside the cluster, on port 443
+	TLS bool `json:"tls,omitempty"`
+	// Egress - the egress gateway service the layer's requests leave the mesh through, none when empty
+	Egress string `json:"egress,omitempty"`
+	// Subset of the destination to route to (optional)
+	Subset string `json:"subset,omitempty"`
+	// Ports the route applies to, each is sent to the same port of the destination (optional)
+	Ports []uint32 `json:"ports,omitempty"`
+	// Entry - additional ways a request can enter the layer (optional)
+	Entry *routelayerv1.LayerEntry `json:"entry,omitempty"`
+	// Enrollment - how users are put into the layer without the header (optional)
+	Enrollment *routelayerv1.LayerEnrollment `json:"enrollment,omitempty"`
+}
+
+// Subset is a named set of pod labels of the host.
+type Subset struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+}
+
+// BuildTable computes the route table for host from the LayerServices overriding it and all known layers.
+// The LayerServices must be normalized, so their hosts can be compared wherever they were written.
+// Layers inherit the override of their nearest ancestor, so every layer beneath an overriding layer gets a route.
+// LayerServices being deleted, or referring to layers which do not exist or are suspended, are ignored.
+func BuildTable(host, namespace string, services []routelayerv1.LayerService, layers []routelayerv1.Layer) Table {
+	t := Table{Host: host, Namespace: namespace, Protocol: routelayerv1.ProtocolHTTP}
+
+	byName := map[string]*routelayerv1.Layer{}
+	for i := range layers {
+		byName[layers[i].Name] = &layers[i]
+	}
+
+	overrides := map[string]*routelayerv1.LayerService{}
+	for i := range services {
+		ls := &services[i]
+		if ls.Spec.Host != host || !ls.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if l, ok := byName[ls.Spec.Layer]; !ok || l.Spec.Suspend {
+			continue
+		}
+		// two LayerServices for the same layer and host is ambiguous - use the first by name.
+		if existing, ok := overrides[ls.Spec.Layer]; ok && existing.Name < ls.Name {
+			continue
+		}
+		overrides[ls.Spec.Layer] = ls
+	}
+	for _, ls := range overrides {
+		t.Protocol = moreCapable(t.Protocol, ls.Spec.Protocol)
+		t.Adopt = t.Adopt || ls.Spec.Adopt
+	}
+	if len(overrides) == 0 {
+		return t
+	}
+
+	subsets := map[string]Subset{}
+	for _, name := range sortedKeys(byName) {
+		provider, fallback := nearestOverride(name, byName, overrides)
+		if provider == nil {
+			continue
+		}
+		r := Route{
+			Layer:       name,
+			Provider:    provider.Spec.Layer,
+			Fallback:    fallback,
+			Destination: host,
+			Ports:       provider.Spec.Ports,
+			Entry:       byName[name].Spec.Entry,
+			Enrollment:  byName[name].Spec.Enrollment,
+		}
+		if provider.Spec.Destination != "" {
+			r.Destination = provider.Spec.Destination
+			r.TLS = provider.Spec.DestinationTLS
+		}
+		r.Egress = provider.Spec.EgressGateway
+		if len(provider.Spec.Labels) > 0 {
+			r.Subset = provider.Spec.Layer
+			subsets[r.Subset] = Subset{Name: r.Subset, Labels: provider.Spec.Labels}
+		}
+		t.Routes = append(t.Routes, r)
+	}
+
+	for _, name := range sortedKeys(subsets) {
+		t.Subsets = append(t.Subsets, subsets[name])
+	}
+	return t
+}
+
+// MarkExternal returns the table with its host, and the destinations of its routes, marked external when they are not
+// cluster services. The mesh only knows them once they are given ServiceEntries, see ExternalResources.
+func MarkExternal(t Table, domain string) Table {
+	_, cluster := HostNamespace(t.Host, domain)
+	t.External = !cluster
+	routes := make([]Route, 0, len(t.Routes))
+	for _, r := range t.Routes {
+		_, cluster := HostNamespace(r.Destination, domain)
+		r.External = !cluster
+		routes = append(routes, r)
+	}
+	t.Routes = routes
+	return t
+}
+
+// RouteEgress returns the table with the requests to its host, when it is outside the cluster, leaving the mesh
+// through egress gateways: those of a layer through its LayerService's gateway, or else through gateway, as do those
+// in no layer. No gateway is used when gateway is empty, or for a host or destination inside the cluster. The table
+// must be marked external first. Hosts speaking tcp or tls can't be routed by layer at a gateway, so leave directly.
+func RouteEgress(t Table, gateway string) Table {
+	opaque := t.Protocol == routelayerv1.ProtocolTCP || t.Protocol == routelayerv1.ProtocolTLS
+	t.Egress = ""
+	if t.External && !opaque {
+		t.Egress = gateway
+	}
+	routes := make([]Route, 0, len(t.Routes))
+	for _, r := range t.Routes {
+		switch {
+		case !t.External || opaque || !r.External:
+			r.Egress = ""
+		case r.Egress == "":
+			r.Egress = gateway
+		}
+		routes = append(routes, r)
+	}
+	t.Routes = routes
+	return t
+}
+
+// nearestOverride walks up the layer tree from name and returns the first LayerService found,
+// and the layers walked to find it.
+func nearestOverride(name string, layers map[string]*routelayerv1.Layer,
+	overrides map[string]*routelayerv1.LayerService) (*routelayerv1.LayerService, []string) {
+	seen := map[string]bool{}
+	walked := []string{}
+	for name != "" && !seen[name] {
+		seen[name] = true
+		walked = append(walked, name)
+		if ls, ok := overrides[name]; ok {
+			return ls, walked
+		}
+		l, ok := layers[name]
+		if !ok {
+			return nil, nil
+		}
+		name = l.Spec.Parent
+	}
+	return nil, nil
+}
+
+// moreCapable returns whichever protocol needs the most from the connection - the host must be treated as that.
+// The opaque protocols (tcp, tls) rank highest, as once any layer needs them no headers can be relied on.
+func moreCapable(a, b string) string {
+	rank := map[string]int{
+		routelayerv1.ProtocolHTTP:  1,
+		routelayerv1.ProtocolHTTP2: 2,
+		routelayerv1.ProtocolGRPC:  3,
+		routelayerv1.ProtocolTCP:   4,
+		routelayerv1.ProtocolTLS:   5,
+	}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package routing
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var TelemetryGVK = schema.GroupVersionKind{Group: "telemetry.istio.io", Version: "v1", Kind: "Telemetry"}
+
+const (
+	// TelemetryName is the name of the Telemetry generated in each namespace taking part in layers.
+	TelemetryName = "routelayer-layers"
+	// LayerTag is the span tag recording the layer a request selected.
+	LayerTag = "routelayer.layer"
+	// LayerMetricTag is the label recording the layer a request selected on istio's request metrics.
+	LayerMetricTag = "routelayer_layer"
+	// DefaultLayerTagValue is recorded for requests which select no layer.
+	DefaultLayerTagValue = "default"
+)
+
+// NewTelemetry returns an empty Telemetry for the given name and namespace, suitable for a Get.
+func NewTelemetry(name, namespace string) *unstructured.Unstructured {
+	return newObject(TelemetryGVK, name, namespace)
+}
+
+// Telemetry renders the telemetry for the workloads of namespace, tagging their spans and request metrics with
+// the layer from header. The metrics are only labelled with the layers given, those the namespace may route, as
+// any other value of the header, which clients choose, would make another series.
+// Their access logs are written by accessLogProvider, when set, which is expected to be a
+// mesh extension provider whose format includes the header.
+// Otherwise only the tags are set, the sampling and providers are inherited from the mesh.
+func Telemetry(namespace, header, accessLogProvider string, layers []string) *unstructured.Unstructured {
+	t := newObject(TelemetryGVK, TelemetryName, namespace)
+	t.SetLabels(map[string]string{ManagedByLabel: ManagedByValue})
+
+	header = strings.ToLower(header)
+	layer := fmt.Sprintf("'%s'", DefaultLayerTagValue)
+	if len(layers) > 0 {
+		known := make([]string, 0, len(layers))
+		for _, l := range layers {
+			known = append(known, fmt.Sprintf("'%s'", l))
+		}
+		layer = fmt.Sprintf("'%s' in request.headers && request.headers['%s'] in [%s] ? request.headers['%s'] : '%s'",
+			header, header, strings.Join(known, ", "), header, DefaultLayerTagValue)
+	}
+	overrides := []interface{}{}
+	for _, metric := range []string{"REQUEST_COUNT", "REQUEST_DURATION"} {
+		overrides = append(overrides, map[string]interface{}{
+			"match":        map[string]interface{}{"metric": metric, "mode": "CLIENT_AND_SERVER"},
+			"tagOverrides": map[string]interface{}{LayerMetricTag: map[string]interface{}{"value": layer}},
+		})
+	}
+	spec := map[string]interface{}{
+		"tracing": []interface{}{
+			map[string]interface{}{
+				"customTags": map[string]interface{}{
+					LayerTag: map[string]interface{}{
+						"header": map[string]interface{}{"name": header, "defaultValue": DefaultLayerTagValue},
+					},
+				},
+			},
+		},
+		"metrics": []interface{}{
+			map[string]interface{}{
+				"providers": []interface{}{map[string]interface{}{"name": "prometheus"}},
+				"overrides": overrides,
+			},
+		},
+	}
+	if accessLogProvider != "" {
+		spec["accessLogging"] = []interface{}{
+			map[string]interface{}{
+				"providers": []interface{}{map[string]interface{}{"name": accessLogProvider}},
+			},
+		}
+	}
+	t.Object["spec"] = spec
+	setApplied(t)
+	return t
+}
@@ -71,6 +71,9 @@ var _ = Describe("RouteTest", Ordered, func() {
 		k8s.WaitUntilPodAvailable(t, options, "test-pod", 10, time.Second*5)
 		k8s.WaitUntilDeploymentAvailable(t, options, "http-echo-deployment-v1", 10, time.Second*5)
 		k8s.WaitUntilDeploymentAvailable(t, options, "http-echo-deployment-v2", 10, time.Second*5)
+		k8s.WaitUntilPodAvailable(t, options, "grpc-client", 10, time.Second*5)
+		k8s.WaitUntilDeploymentAvailable(t, options, "grpc-echo-deployment-v1", 10, time.Second*5)
+		k8s.WaitUntilDeploymentAvailable(t, options, "grpc-echo-deployment-v2", 10, time.Second*5)
 		log.Info("Test pod has come up")
 	})
 
@@ -124,4 +127,41 @@ var _ = Describe("RouteTest", Ordered, func() {
 			Expect(result).To(ContainSubstring("v1"))
 		})
 	})
+
+	Context("MultiPortRouteTest", func() {
+
+		It("should route to v1 when exec a curl to the http-echo admin port with header v2", func() {
+			httpServiceEndpoint := fmt.Sprintf("http://http-echo.%s.svc.cluster.local:9090/", namespaceName)
+			// the layer only overrides port 8080, so the admin port stays on the default route
+			result, err := k8s.RunKubectlAndGetOutputE(t, options, "exec", "test-pod", "--",
+				"curl", "-sH", "x-route: v2", httpServiceEndpoint)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(ContainSubstring("v1"))
+		})
+	})
+
+	Context("GRPCRouteTest", func() {
+
+		// grpcEcho execs the echo client in grpc-client to make a gRPC echo request with the given headers (metadata)
+		grpcEcho := func(headers ...string) (string, error) {
+			grpcServiceEndpoint := fmt.Sprintf("grpc://grpc-echo.%s.svc.cluster.local:7070", namespaceName)
+			args := []string{"exec", "grpc-client", "--", "client", "--url", grpcServiceEndpoint}
+			for _, h := range headers {
+				args = append(args, "-H", h)
+			}
+			return k8s.RunKubectlAndGetOutputE(t, options, args...)
+		}
+
+		It("should route to v1 when making a gRPC request to grpc-echo service", func() {
+			result, err := grpcEcho()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(ContainSubstring("ServiceVersion=v1"))
+		})
+
+		It("should route to v2 when making a gRPC request to grpc-echo service with metadata v2", func() {
+			result, err := grpcEcho("x-route: v2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(ContainSubstring("ServiceVersion=v2"))
+		})
+	})
 })